@@ -18,7 +18,8 @@ func main() {
     for _, cfg := range cfgs {
         sec, err := porthop.DecodeSecret(cfg.TOTPSecret)
         if err != nil { log.Fatal(err) }
-        cl := client.New(cfg, sec)
+        cl, err := client.New(cfg, sec)
+        if err != nil { log.Fatal(err) }
         wg.Add(1)
         go func(c *client.Client) {
             defer wg.Done()
@@ -2,8 +2,12 @@ package main
 
 import (
     "context"
+    "errors"
     "flag"
     "log"
+    "net"
+    "net/http"
+    "net/netip"
     "sync"
     "time"
     "okaroute/internal/config"
@@ -13,21 +17,44 @@ import (
 
 func main() {
     cfgPath := flag.String("config", "configs/server.json", "path to server config")
+    adminAddr := flag.String("admin", "", "loopback address for the admin endpoint (bans), e.g. 127.0.0.1:9900")
     flag.Parse()
+    if *adminAddr != "" {
+        if err := checkLoopback(*adminAddr); err != nil { log.Fatal(err) }
+    }
     cfgs, err := config.LoadServerConfigs(*cfgPath)
     if err != nil { log.Fatal(err) }
     var wg sync.WaitGroup
     ctx, cancel := context.WithCancel(context.Background())
     defer cancel()
+    var servers []*server.Server
     for _, cfg := range cfgs {
         sec, err := porthop.DecodeSecret(cfg.TOTPSecret)
         if err != nil { log.Fatal(err) }
-        srv := server.New(cfg, sec)
+        srv, err := server.New(cfg, sec)
+        if err != nil { log.Fatal(err) }
+        servers = append(servers, srv)
         wg.Add(1)
         go func(s *server.Server) {
             defer wg.Done()
             if err := s.Start(ctx); err != nil { log.Println(err) }
         }(srv)
     }
+    if *adminAddr != "" {
+        go func() { log.Println(http.ListenAndServe(*adminAddr, server.AdminHandler(servers))) }()
+    }
     time.Sleep(time.Hour)
+}
+
+// checkLoopback refuses admin addresses outside the loopback interface; the
+// admin endpoint, including POST /unban, has no authentication.
+func checkLoopback(addr string) error {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil { return err }
+    if host == "localhost" { return nil }
+    ip, err := netip.ParseAddr(host)
+    if err != nil || !ip.Unmap().IsLoopback() {
+        return errors.New("admin address must be on loopback: " + addr)
+    }
+    return nil
 }
\ No newline at end of file
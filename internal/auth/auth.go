@@ -3,25 +3,19 @@ package auth
 import (
     "crypto/hmac"
     "crypto/rand"
-    "crypto/sha256"
 )
 
-func Issue(secret []byte, step int64, clientID string) ([]byte, []byte) {
+// newNonce returns a random 16-byte handshake nonce.
+func newNonce() []byte {
     nonce := make([]byte, 16)
     rand.Read(nonce)
-    mac := hmac.New(sha256.New, secret)
-    var b [8]byte
-    for i := 0; i < 8; i++ {
-        b[7-i] = byte(step >> (8 * uint(i)))
-    }
-    mac.Write(b[:])
-    mac.Write(nonce)
-    mac.Write([]byte(clientID))
-    return nonce, mac.Sum(nil)
+    return nonce
 }
 
-func Verify(secret []byte, step int64, nonce []byte, token []byte, clientID string) bool {
-    mac := hmac.New(sha256.New, secret)
+func sign(secret []byte, suite Suite, flags byte, step int64, nonce []byte, clientID string, pub []byte) []byte {
+    mac := hmac.New(suite.MAC.New, secret)
+    if suite != DefaultSuite { mac.Write(suite.code()) }
+    if flags != 0 { mac.Write([]byte{flags}) }
     var b [8]byte
     for i := 0; i < 8; i++ {
         b[7-i] = byte(step >> (8 * uint(i)))
@@ -29,6 +23,6 @@ func Verify(secret []byte, step int64, nonce []byte, token []byte, clientID stri
     mac.Write(b[:])
     mac.Write(nonce)
     mac.Write([]byte(clientID))
-    expect := mac.Sum(nil)
-    return hmac.Equal(expect, token)
+    mac.Write(pub)
+    return mac.Sum(nil)[:suite.MACLen]
 }
\ No newline at end of file
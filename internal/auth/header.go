@@ -0,0 +1,147 @@
+package auth
+
+import (
+    "crypto/hmac"
+    "encoding/binary"
+    "errors"
+    "io"
+)
+
+const (
+    Version1 = 1
+    // Version2 adds an ephemeral X25519 public key covered by the token.
+    Version2 = 2
+    // VersionSuite is set on the version byte when the header uses a
+    // non-default Suite; two suite bytes then follow the version.
+    VersionSuite = 0x10
+    // VersionAck asks the server to confirm a version 1 handshake with an
+    // AckMAC before any payload, so a client that reached some other service
+    // on a hop port can tell and move on.
+    VersionAck = 0x20
+    // VersionSealed marks a version 1 header whose payload is encrypted with
+    // keys from SessionKeys, so both ends agree on the encryption mode.
+    VersionSealed = 0x40
+)
+
+// headerFlags are the version bits kept in Header.Flags and covered by the
+// token.
+const headerFlags = VersionAck | VersionSealed
+
+const versionFlags = VersionSuite | headerFlags
+
+const MaxClientIDLen = 255
+
+const PubKeyLen = 32
+
+var ErrVersion = errors.New("unsupported handshake version")
+
+type Header struct {
+    Version byte
+    Step int64
+    Nonce []byte
+    ClientID string
+    PubKey []byte
+    Suite Suite
+    Flags byte
+    Token []byte
+}
+
+// NewHeader returns a version 1 header; flags is a combination of
+// headerFlags.
+func NewHeader(secret []byte, step int64, clientID string, suite Suite, flags byte) *Header {
+    nonce := newNonce()
+    return &Header{Version: Version1, Step: step, Nonce: nonce, ClientID: clientID, Suite: suite, Flags: flags, Token: sign(secret, suite, flags, step, nonce, clientID, nil)}
+}
+
+func NewKeyExchangeHeader(secret []byte, step int64, clientID string, pub []byte, suite Suite) *Header {
+    nonce := newNonce()
+    return &Header{Version: Version2, Step: step, Nonce: nonce, ClientID: clientID, PubKey: pub, Suite: suite, Token: sign(secret, suite, 0, step, nonce, clientID, pub)}
+}
+
+func (h *Header) Verify(secret []byte) bool {
+    return hmac.Equal(sign(secret, h.Suite, h.Flags, h.Step, h.Nonce, h.ClientID, h.PubKey), h.Token)
+}
+
+// Marshal encodes the header as version(1) [suite(2)] step(8) nonce(16)
+// id_len(1) id [pubkey(32), v2 only] token(mac_len).
+func (h *Header) Marshal() []byte {
+    b := make([]byte, 0, 3+8+16+1+len(h.ClientID)+len(h.PubKey)+len(h.Token))
+    if h.Suite == DefaultSuite {
+        b = append(b, h.Version|h.Flags)
+    } else {
+        b = append(b, h.Version|h.Flags|VersionSuite)
+        b = append(b, h.Suite.code()...)
+    }
+    b = binary.BigEndian.AppendUint64(b, uint64(h.Step))
+    b = append(b, h.Nonce...)
+    b = append(b, byte(len(h.ClientID)))
+    b = append(b, h.ClientID...)
+    b = append(b, h.PubKey...)
+    b = append(b, h.Token...)
+    return b
+}
+
+func ReadHeader(r io.Reader) (*Header, error) {
+    b := make([]byte, 1, 3+8+16+1)
+    if _, err := io.ReadFull(r, b); err != nil { return nil, err }
+    pre, err := prefixLen(b[0])
+    if err != nil { return nil, err }
+    b = b[:pre]
+    if _, err := io.ReadFull(r, b[1:]); err != nil { return nil, err }
+    suite, err := parseSuite(b)
+    if err != nil { return nil, err }
+    b = b[:pre+8+16+1]
+    if _, err := io.ReadFull(r, b[pre:]); err != nil { return nil, err }
+    rest := make([]byte, tailLen(b[0], int(b[len(b)-1]), suite))
+    if _, err := io.ReadFull(r, rest); err != nil { return nil, err }
+    h, _, err := ParseHeader(append(b, rest...))
+    return h, err
+}
+
+func ParseHeader(b []byte) (*Header, int, error) {
+    if len(b) < 1 { return nil, 0, io.ErrUnexpectedEOF }
+    pre, err := prefixLen(b[0])
+    if err != nil { return nil, 0, err }
+    if len(b) < pre+8+16+1 { return nil, 0, io.ErrUnexpectedEOF }
+    suite, err := parseSuite(b)
+    if err != nil { return nil, 0, err }
+    idLen := int(b[pre+24])
+    n := pre + 8 + 16 + 1 + tailLen(b[0], idLen, suite)
+    if len(b) < n { return nil, 0, io.ErrUnexpectedEOF }
+    h := &Header{
+        Version: b[0] &^ versionFlags,
+        Step: int64(binary.BigEndian.Uint64(b[pre : pre+8])),
+        Nonce: append([]byte(nil), b[pre+8:pre+24]...),
+        ClientID: string(b[pre+25 : pre+25+idLen]),
+        Suite: suite,
+        Flags: b[0] & headerFlags,
+    }
+    off := pre + 25 + idLen
+    if h.Version == Version2 {
+        h.PubKey = append([]byte(nil), b[off:off+PubKeyLen]...)
+        off += PubKeyLen
+    }
+    h.Token = append([]byte(nil), b[off:n]...)
+    return h, n, nil
+}
+
+// prefixLen returns the length of the version byte plus any suite bytes.
+func prefixLen(version byte) (int, error) {
+    switch version &^ versionFlags {
+    case Version1, Version2:
+    default:
+        return 0, ErrVersion
+    }
+    if version&VersionSuite != 0 { return 3, nil }
+    return 1, nil
+}
+
+func parseSuite(b []byte) (Suite, error) {
+    if b[0]&VersionSuite == 0 { return DefaultSuite, nil }
+    return suiteFromCode(b[1:3])
+}
+
+func tailLen(version byte, idLen int, suite Suite) int {
+    if version&^versionFlags == Version2 { return idLen + PubKeyLen + suite.MACLen }
+    return idLen + suite.MACLen
+}
\ No newline at end of file
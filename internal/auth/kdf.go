@@ -0,0 +1,34 @@
+package auth
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+)
+
+// hkdf implements RFC 5869 with SHA-256.
+func hkdf(secret, salt, info []byte, n int) []byte {
+    ext := hmac.New(sha256.New, salt)
+    ext.Write(secret)
+    prk := ext.Sum(nil)
+    out := make([]byte, 0, n)
+    var prev []byte
+    for i := byte(1); len(out) < n; i++ {
+        m := hmac.New(sha256.New, prk)
+        m.Write(prev)
+        m.Write(info)
+        m.Write([]byte{i})
+        prev = m.Sum(nil)
+        out = append(out, prev...)
+    }
+    return out[:n]
+}
+
+// SessionKeys derives the client-to-server and server-to-client payload keys
+// for one handshake.
+func SessionKeys(secret []byte, step int64, nonce []byte, clientID string) ([]byte, []byte) {
+    info := binary.BigEndian.AppendUint64([]byte("okaroute session"), uint64(step))
+    info = append(info, clientID...)
+    k := hkdf(secret, nonce, info, 64)
+    return k[:32], k[32:]
+}
\ No newline at end of file
@@ -0,0 +1,47 @@
+package auth
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+)
+
+// ReplyMAC authenticates the server's ephemeral public key, bound to the
+// client's header token.
+func ReplyMAC(secret []byte, h *Header, serverPub []byte) []byte {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte("okaroute kx reply"))
+    mac.Write(h.Token)
+    mac.Write(serverPub)
+    return mac.Sum(nil)
+}
+
+func VerifyReply(secret []byte, h *Header, serverPub, tag []byte) bool {
+    return hmac.Equal(ReplyMAC(secret, h, serverPub), tag)
+}
+
+// AckLen is the length of the server's confirmation of a version 1 handshake.
+const AckLen = 32
+
+// AckMAC confirms a version 1 header that set VersionAck, bound to its token.
+func AckMAC(secret []byte, h *Header) []byte {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte("okaroute ack"))
+    mac.Write(h.Token)
+    return mac.Sum(nil)
+}
+
+func VerifyAck(secret []byte, h *Header, tag []byte) bool {
+    return hmac.Equal(AckMAC(secret, h), tag)
+}
+
+// KeyExchangeKeys derives the client-to-server and server-to-client payload
+// keys from an X25519 shared secret and the handshake transcript.
+func KeyExchangeKeys(shared []byte, h *Header, serverPub []byte) ([]byte, []byte) {
+    info := binary.BigEndian.AppendUint64([]byte("okaroute kx session"), uint64(h.Step))
+    info = append(info, h.ClientID...)
+    info = append(info, h.PubKey...)
+    info = append(info, serverPub...)
+    k := hkdf(shared, h.Nonce, info, 64)
+    return k[:32], k[32:]
+}
\ No newline at end of file
@@ -0,0 +1,58 @@
+package auth
+
+import (
+    "encoding/binary"
+    "sync"
+    "time"
+)
+
+type replayEntry struct {
+    key string
+    expires time.Time
+}
+
+type ReplayCache struct {
+    mu sync.Mutex
+    ttl time.Duration
+    max int
+    seen map[string]time.Time
+    queue []replayEntry
+}
+
+func NewReplayCache(ttl time.Duration, max int) *ReplayCache {
+    return &ReplayCache{ttl: ttl, max: max, seen: map[string]time.Time{}}
+}
+
+// Seen records the nonce for (clientID, step) and reports whether it was
+// already recorded and not yet expired.
+func (r *ReplayCache) Seen(clientID string, step int64, nonce []byte) bool {
+    var b [8]byte
+    binary.BigEndian.PutUint64(b[:], uint64(step))
+    key := clientID + "\x00" + string(b[:]) + string(nonce)
+    now := time.Now()
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.expire(now)
+    if exp, ok := r.seen[key]; ok && now.Before(exp) {
+        return true
+    }
+    for len(r.queue) >= r.max && len(r.queue) > 0 {
+        delete(r.seen, r.queue[0].key)
+        r.queue = r.queue[1:]
+    }
+    exp := now.Add(r.ttl)
+    r.seen[key] = exp
+    r.queue = append(r.queue, replayEntry{key: key, expires: exp})
+    return false
+}
+
+func (r *ReplayCache) expire(now time.Time) {
+    i := 0
+    for i < len(r.queue) && !now.Before(r.queue[i].expires) {
+        delete(r.seen, r.queue[i].key)
+        i++
+    }
+    if i > 0 {
+        r.queue = append(r.queue[:0], r.queue[i:]...)
+    }
+}
\ No newline at end of file
@@ -0,0 +1,78 @@
+package auth
+
+import (
+    "crypto"
+    _ "crypto/sha1"
+    _ "crypto/sha256"
+    _ "crypto/sha512"
+    "errors"
+    "strconv"
+)
+
+// Suite is the algorithm selection both peers must share: the digest used
+// for port derivation and the HMAC digest and truncated length of the
+// handshake token. Anything other than DefaultSuite is announced in the
+// header so a mismatch is reported as such rather than as a bad token.
+type Suite struct {
+    Hop crypto.Hash
+    MAC crypto.Hash
+    MACLen int
+}
+
+var DefaultSuite = Suite{Hop: crypto.SHA1, MAC: crypto.SHA256, MACLen: 32}
+
+const MinMACLen = 16
+
+var ErrSuite = errors.New("unsupported handshake algorithm")
+
+var hashNames = map[string]crypto.Hash{"sha1": crypto.SHA1, "sha256": crypto.SHA256, "sha512": crypto.SHA512}
+
+var hashIDs = map[crypto.Hash]byte{crypto.SHA1: 1, crypto.SHA256: 2, crypto.SHA512: 3}
+
+// ParseSuite builds a suite from config names. Empty values select the
+// defaults; a zero macLen means the full digest.
+func ParseSuite(hop, mac string, macLen int) (Suite, error) {
+    s := DefaultSuite
+    if hop != "" {
+        h, ok := hashNames[hop]
+        if !ok { return s, errors.New("invalid hop_hash") }
+        s.Hop = h
+    }
+    if mac != "" {
+        h, ok := hashNames[mac]
+        if !ok || h == crypto.SHA1 { return s, errors.New("invalid mac_hash") }
+        s.MAC = h
+    }
+    s.MACLen = s.MAC.Size()
+    if macLen != 0 {
+        if macLen < MinMACLen || macLen > s.MAC.Size() { return s, errors.New("invalid mac_length") }
+        s.MACLen = macLen
+    }
+    return s, nil
+}
+
+func (s Suite) String() string {
+    return "hop=" + hashName(s.Hop) + " mac=" + hashName(s.MAC) + "/" + strconv.Itoa(s.MACLen)
+}
+
+func hashName(h crypto.Hash) string {
+    for k, v := range hashNames {
+        if v == h { return k }
+    }
+    return "unknown"
+}
+
+func (s Suite) code() []byte {
+    return []byte{hashIDs[s.Hop]<<4 | hashIDs[s.MAC], byte(s.MACLen)}
+}
+
+func suiteFromCode(b []byte) (Suite, error) {
+    var s Suite
+    for h, id := range hashIDs {
+        if id == b[0]>>4 { s.Hop = h }
+        if id == b[0]&0x0f { s.MAC = h }
+    }
+    s.MACLen = int(b[1])
+    if s.Hop == 0 || s.MAC == 0 || s.MAC == crypto.SHA1 || s.MACLen < MinMACLen || s.MACLen > s.MAC.Size() { return s, ErrSuite }
+    return s, nil
+}
\ No newline at end of file
@@ -0,0 +1,82 @@
+package auth
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "io"
+    "time"
+)
+
+// Time probes let a client with a skewed clock learn the server's time.
+// Request: type(1) nonce(16) id_len(1) id mac(32).
+// Reply:   type(1) nonce(16) unix_ms(8) mac(32).
+const (
+    timeProbeRequest = 'T'
+    timeProbeReply = 't'
+)
+
+var ErrTimeProbe = errors.New("invalid time probe")
+
+type TimeProbe struct {
+    Nonce []byte
+    ClientID string
+    MAC []byte
+}
+
+func NewTimeProbe(secret []byte, clientID string) *TimeProbe {
+    nonce := newNonce()
+    return &TimeProbe{Nonce: nonce, ClientID: clientID, MAC: timeProbeMAC(secret, nonce, clientID)}
+}
+
+func (p *TimeProbe) Marshal() []byte {
+    b := make([]byte, 0, 1+16+1+len(p.ClientID)+32)
+    b = append(b, timeProbeRequest)
+    b = append(b, p.Nonce...)
+    b = append(b, byte(len(p.ClientID)))
+    b = append(b, p.ClientID...)
+    return append(b, p.MAC...)
+}
+
+func ParseTimeProbe(b []byte) (*TimeProbe, error) {
+    if len(b) < 1+16+1 { return nil, io.ErrUnexpectedEOF }
+    if b[0] != timeProbeRequest { return nil, ErrTimeProbe }
+    idLen := int(b[17])
+    if len(b) != 1+16+1+idLen+32 { return nil, ErrTimeProbe }
+    return &TimeProbe{Nonce: append([]byte(nil), b[1:17]...), ClientID: string(b[18 : 18+idLen]), MAC: append([]byte(nil), b[18+idLen:]...)}, nil
+}
+
+func (p *TimeProbe) Verify(secret []byte) bool {
+    return hmac.Equal(timeProbeMAC(secret, p.Nonce, p.ClientID), p.MAC)
+}
+
+// TimeReply answers p with the server time now, bound to the probe nonce.
+func TimeReply(secret []byte, p *TimeProbe, now time.Time) []byte {
+    b := make([]byte, 0, 1+16+8+32)
+    b = append(b, timeProbeReply)
+    b = append(b, p.Nonce...)
+    b = binary.BigEndian.AppendUint64(b, uint64(now.UnixMilli()))
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte("okaroute time reply"))
+    mac.Write(b[1:])
+    return mac.Sum(b)
+}
+
+// ParseTimeReply checks a reply to p and returns the server time it carries.
+func ParseTimeReply(secret []byte, p *TimeProbe, b []byte) (time.Time, error) {
+    if len(b) != 1+16+8+32 || b[0] != timeProbeReply || !hmac.Equal(b[1:17], p.Nonce) { return time.Time{}, ErrTimeProbe }
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte("okaroute time reply"))
+    mac.Write(b[1:25])
+    if !hmac.Equal(mac.Sum(nil), b[25:]) { return time.Time{}, ErrTimeProbe }
+    return time.UnixMilli(int64(binary.BigEndian.Uint64(b[17:25]))), nil
+}
+
+func timeProbeMAC(secret, nonce []byte, clientID string) []byte {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte("okaroute time probe"))
+    mac.Write(nonce)
+    mac.Write([]byte(clientID))
+    return mac.Sum(nil)
+}
\ No newline at end of file
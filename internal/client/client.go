@@ -1,28 +1,70 @@
 package client
 
 import (
-    "encoding/binary"
+    "crypto/ecdh"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
     "io"
     "log"
     "net"
+    "os"
     "strconv"
+    "sync"
+    "sync/atomic"
     "time"
     "okaroute/internal/auth"
     "okaroute/internal/config"
     "okaroute/internal/porthop"
+    "okaroute/internal/secure"
 )
 
 type Client struct {
     cfg config.ClientConfig
     secret []byte
+    hopSecret []byte
+    versions []secretVersion
+    offset atomic.Int64
     name string
+    tlsConf *tls.Config
 }
 
-func New(cfg config.ClientConfig, secret []byte) *Client {
-    return &Client{cfg: cfg, secret: secret, name: cfg.Name}
+func New(cfg config.ClientConfig, secret []byte) (*Client, error) {
+    c := &Client{cfg: cfg, secret: secret, hopSecret: secret, name: cfg.Name}
+    if cfg.HopSecret != "" {
+        hop, err := porthop.DecodeSecret(cfg.HopSecret)
+        if err != nil { return nil, errors.New("invalid hop_secret") }
+        c.hopSecret = hop
+    }
+    for i, v := range cfg.Secrets {
+        sec, err := porthop.DecodeSecret(v.Secret)
+        if err != nil { return nil, errors.New("secrets[" + itoa(i) + "]: invalid secret") }
+        c.versions = append(c.versions, secretVersion{key: sec, activate: v.ActivateAt, expire: v.ExpireAt})
+    }
+    if cfg.TLS.Enabled {
+        c.tlsConf = &tls.Config{ServerName: cfg.TLS.ServerName, InsecureSkipVerify: cfg.TLS.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+        if cfg.TLS.CAFile != "" {
+            pem, err := os.ReadFile(cfg.TLS.CAFile)
+            if err != nil { return nil, err }
+            pool := x509.NewCertPool()
+            if !pool.AppendCertsFromPEM(pem) { return nil, errors.New("tls ca_file contains no certificates") }
+            c.tlsConf.RootCAs = pool
+        }
+        if cfg.TLS.CertFile != "" {
+            cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+            if err != nil { return nil, err }
+            c.tlsConf.Certificates = []tls.Certificate{cert}
+        }
+    }
+    return c, nil
 }
 
 func (c *Client) Start() error {
+    if c.cfg.TimeProbePort > 0 {
+        c.probeTime()
+        go c.timeProbeLoop()
+    }
     if c.cfg.Protocol == "udp" {
         return c.startUDP()
     }
@@ -38,27 +80,139 @@ func (c *Client) Start() error {
 
 func itoa(i int) string { return strconv.FormatInt(int64(i), 10) }
 
-func (c *Client) dialServerPort(step int64, host string) (net.Conn, int, error) {
-    prev, curr, next := porthop.Triplet(c.secret, step, c.cfg.PortRange.Min, c.cfg.PortRange.Max)
-    ports := []int{curr, prev, next}
-    for _, p := range porthop.UniquePorts(ports) {
-        conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, itoa(p)), 3*time.Second)
-        if err == nil { return conn, p, nil }
+// now is the local clock corrected by the offset learned from time probes.
+func (c *Client) now() time.Time {
+    return time.Now().Add(time.Duration(c.offset.Load()) * time.Millisecond)
+}
+
+func (c *Client) timeProbeLoop() {
+    t := time.NewTicker(time.Duration(c.cfg.TimeProbeIntervalSeconds) * time.Second)
+    defer t.Stop()
+    for range t.C { c.probeTime() }
+}
+
+// probeTime asks the server for its clock and stores the estimated offset,
+// taking the reply to describe the midpoint of the round trip. On failure the
+// previous estimate is kept.
+func (c *Client) probeTime() {
+    sec, _ := c.secretsAt(c.now())
+    p := auth.NewTimeProbe(sec, c.cfg.ClientID)
+    conn, err := net.Dial("udp", net.JoinHostPort(c.cfg.ServerHosts[0], itoa(c.cfg.TimeProbePort)))
+    if err != nil { return }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(3 * time.Second))
+    sent := time.Now()
+    if _, err := conn.Write(p.Marshal()); err != nil { return }
+    buf := make([]byte, 128)
+    n, err := conn.Read(buf)
+    var server time.Time
+    if err == nil { server, err = auth.ParseTimeReply(sec, p, buf[:n]) }
+    if err != nil {
+        if c.name != "" { log.Printf("[%s] 客户端校时失败: 服务器=%s 错误=%v", c.name, c.cfg.ServerHosts[0], err) } else { log.Printf("客户端校时失败: 服务器=%s 错误=%v", c.cfg.ServerHosts[0], err) }
+        return
+    }
+    recv := time.Now()
+    rtt := recv.Sub(sent)
+    off := server.Add(rtt / 2).Sub(recv)
+    c.offset.Store(off.Milliseconds())
+    if c.name != "" { log.Printf("[%s] 客户端校时: 服务器=%s 时钟偏移=%v 往返=%v", c.name, c.cfg.ServerHosts[0], off.Round(time.Millisecond), rtt.Round(time.Millisecond)) } else { log.Printf("客户端校时: 服务器=%s 时钟偏移=%v 往返=%v", c.cfg.ServerHosts[0], off.Round(time.Millisecond), rtt.Round(time.Millisecond)) }
+}
+
+type secretVersion struct {
+    key []byte
+    activate time.Time
+    expire time.Time
+}
+
+// secretsAt returns the auth and hop secrets to use at t: the most recently
+// activated unexpired entry of secrets, or totp_secret when none applies.
+// An explicit hop_secret always takes precedence for port selection.
+func (c *Client) secretsAt(t time.Time) ([]byte, []byte) {
+    sec := c.secret
+    var best *secretVersion
+    for i := range c.versions {
+        v := &c.versions[i]
+        if !v.activate.IsZero() && t.Before(v.activate) { continue }
+        if !v.expire.IsZero() && !t.Before(v.expire) { continue }
+        if best == nil || v.activate.After(best.activate) { best = v }
     }
-    return nil, 0, net.ErrClosed
+    if best != nil { sec = best.key }
+    if c.cfg.HopSecret != "" { return sec, c.hopSecret }
+    return sec, sec
+}
+
+// candidateEndpoints lists the endpoints to try for step: the primary
+// endpoint of each step in the window, nearest first (step, -1, +1, -2, +2,
+// ...), then their alternates in the same order.
+func (c *Client) candidateEndpoints(step int64, hop []byte) []porthop.Endpoint {
+    chains := [][]porthop.Endpoint{}
+    for _, st := range porthop.WindowOrder(step, c.cfg.WindowBeforeSteps, c.cfg.WindowAfterSteps) {
+        chains = append(chains, porthop.Endpoints(c.cfg.HopStrategy, c.cfg.Suite.Hop, hop, st, c.cfg.HopAlternates, len(c.cfg.ServerHosts)))
+    }
+    var eps []porthop.Endpoint
+    seen := map[porthop.Endpoint]struct{}{}
+    for k := 0; k <= c.cfg.HopAlternates; k++ {
+        for _, ch := range chains {
+            if _, ok := seen[ch[k]]; ok { continue }
+            seen[ch[k]] = struct{}{}
+            eps = append(eps, ch[k])
+        }
+    }
+    return eps
+}
+
+// stepHost returns the server host that hop assigns to step.
+func (c *Client) stepHost(step int64, hop []byte) string {
+    return c.cfg.ServerHosts[porthop.AddressIndex(c.cfg.Suite.Hop, hop, step, len(c.cfg.ServerHosts))]
+}
+
+// dialServerPort connects to the first reachable endpoint in eps and returns
+// its host and port along with the endpoints not yet tried.
+func (c *Client) dialServerPort(eps []porthop.Endpoint) (net.Conn, string, int, []porthop.Endpoint, error) {
+    for i, e := range eps {
+        host := c.cfg.ServerHosts[e.Addr]
+        conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, itoa(e.Port)), 3*time.Second)
+        if err != nil { continue }
+        if c.tlsConf == nil { return conn, host, e.Port, eps[i+1:], nil }
+        conf := c.tlsConf
+        if conf.ServerName == "" { conf = conf.Clone(); conf.ServerName = host }
+        tc := tls.Client(conn, conf)
+        tc.SetDeadline(time.Now().Add(5 * time.Second))
+        if err := tc.Handshake(); err != nil {
+            if c.name != "" { log.Printf("[%s] 客户端TLS握手失败: 服务器=%s 端口=%d 错误=%v", c.name, host, e.Port, err) } else { log.Printf("客户端TLS握手失败: 服务器=%s 端口=%d 错误=%v", host, e.Port, err) }
+            tc.Close()
+            continue
+        }
+        tc.SetDeadline(time.Time{})
+        return tc, host, e.Port, eps[i+1:], nil
+    }
+    return nil, "", 0, nil, net.ErrClosed
 }
 
 func (c *Client) handleLocal(local net.Conn) {
-    step := porthop.StepIndex(time.Now(), c.cfg.StepSeconds)
-    rc, sp, err := c.dialServerPort(step, c.cfg.ServerHost)
-    if err != nil { local.Close(); return }
-    nonce, token := auth.Issue(c.secret, step, c.cfg.ClientID)
-    var hdr [8 + 16 + 32]byte
-    binary.BigEndian.PutUint64(hdr[0:8], uint64(step))
-    copy(hdr[8:24], nonce)
-    copy(hdr[24:56], token)
-    rc.Write(hdr[:])
-    if c.name != "" { log.Printf("[%s] 客户端建立转发: 来源=%s 服务器=%s 使用端口=%d step=%d", c.name, local.RemoteAddr().String(), c.cfg.ServerHost, sp, step) } else { log.Printf("客户端建立转发: 来源=%s 服务器=%s 使用端口=%d step=%d", local.RemoteAddr().String(), c.cfg.ServerHost, sp, step) }
+    now := c.now()
+    step := porthop.StepIndex(now, c.cfg.StepDuration)
+    sec, hop := c.secretsAt(now)
+    if c.cfg.Knock.Enabled { c.knock(step, c.stepHost(step, hop), sec, hop) }
+    var rc net.Conn
+    var host string
+    var sp int
+    var c2s, s2c []byte
+    eps := c.candidateEndpoints(step, hop)
+    for {
+        var err error
+        rc, host, sp, eps, err = c.dialServerPort(eps)
+        if err != nil { local.Close(); return }
+        if c2s, s2c, err = c.handshake(rc, step, sec); err == nil { break }
+        if c.name != "" { log.Printf("[%s] 客户端握手失败: 服务器=%s 使用端口=%d 错误=%v", c.name, host, sp, err) } else { log.Printf("客户端握手失败: 服务器=%s 使用端口=%d 错误=%v", host, sp, err) }
+        rc.Close()
+    }
+    if c2s != nil {
+        sc, err := secure.NewConn(rc, c2s, s2c)
+        if err != nil { local.Close(); rc.Close(); return }
+        rc = sc
+    }
+    if c.name != "" { log.Printf("[%s] 客户端建立转发: 来源=%s 服务器=%s 使用端口=%d step=%d", c.name, local.RemoteAddr().String(), host, sp, step) } else { log.Printf("客户端建立转发: 来源=%s 服务器=%s 使用端口=%d step=%d", local.RemoteAddr().String(), host, sp, step) }
     done := make(chan struct{}, 2)
     go func() { io.Copy(local, rc); done <- struct{}{} }()
     go func() { io.Copy(rc, local); done <- struct{}{} }()
@@ -67,60 +221,221 @@ func (c *Client) handleLocal(local net.Conn) {
     rc.Close()
 }
 
+// knock sends the UDP knock sequence for step so the server opens its hop
+// listeners to this source address.
+func (c *Client) knock(step int64, host string, secret, hop []byte) {
+    sec := porthop.LabelSecret(hop, "okaroute knock")
+    for _, p := range porthop.KnockPorts(c.cfg.Suite.Hop, sec, step, c.cfg.Knock.Count, c.cfg.PortSet) {
+        conn, err := net.Dial("udp", net.JoinHostPort(host, itoa(p)))
+        if err != nil { return }
+        conn.Write(auth.NewHeader(secret, step, c.cfg.ClientID, c.cfg.Suite, 0).Marshal())
+        conn.Close()
+        time.Sleep(20 * time.Millisecond)
+    }
+    time.Sleep(100 * time.Millisecond)
+}
+
+// handshake writes the header on rc, waits for the server to confirm it and
+// returns the payload keys, or nil keys when payload encryption is disabled.
+func (c *Client) handshake(rc net.Conn, step int64, secret []byte) ([]byte, []byte, error) {
+    if !c.cfg.ForwardSecrecy {
+        h := auth.NewHeader(secret, step, c.cfg.ClientID, c.cfg.Suite, c.headerFlags())
+        if _, err := rc.Write(h.Marshal()); err != nil { return nil, nil, err }
+        ack := make([]byte, auth.AckLen)
+        rc.SetReadDeadline(time.Now().Add(5 * time.Second))
+        if _, err := io.ReadFull(rc, ack); err != nil { return nil, nil, err }
+        rc.SetReadDeadline(time.Time{})
+        if !auth.VerifyAck(secret, h, ack) { return nil, nil, errAck }
+        if c.cfg.Encryption == "none" { return nil, nil, nil }
+        c2s, s2c := auth.SessionKeys(secret, step, h.Nonce, c.cfg.ClientID)
+        return c2s, s2c, nil
+    }
+    priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil { return nil, nil, err }
+    h := auth.NewKeyExchangeHeader(secret, step, c.cfg.ClientID, priv.PublicKey().Bytes(), c.cfg.Suite)
+    if _, err := rc.Write(h.Marshal()); err != nil { return nil, nil, err }
+    reply := make([]byte, auth.PubKeyLen+32)
+    rc.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.ReadFull(rc, reply); err != nil { return nil, nil, err }
+    rc.SetReadDeadline(time.Time{})
+    return c.finishKeyExchange(secret, priv, h, reply)
+}
+
+func (c *Client) finishKeyExchange(secret []byte, priv *ecdh.PrivateKey, h *auth.Header, reply []byte) ([]byte, []byte, error) {
+    if len(reply) != auth.PubKeyLen+32 { return nil, nil, errKeyExchange }
+    serverPub := reply[:auth.PubKeyLen]
+    if !auth.VerifyReply(secret, h, serverPub, reply[auth.PubKeyLen:]) { return nil, nil, errKeyExchange }
+    peer, err := ecdh.X25519().NewPublicKey(serverPub)
+    if err != nil { return nil, nil, err }
+    shared, err := priv.ECDH(peer)
+    if err != nil { return nil, nil, err }
+    c2s, s2c := auth.KeyExchangeKeys(shared, h, serverPub)
+    return c2s, s2c, nil
+}
+
+// headerFlags returns the version 1 header flags: always ask for an
+// acknowledgement and announce whether the payload is sealed.
+func (c *Client) headerFlags() byte {
+    if c.cfg.Encryption == "none" { return auth.VersionAck }
+    return auth.VersionAck | auth.VersionSealed
+}
+
+var errKeyExchange = errors.New("invalid key exchange reply")
+
+var errAck = errors.New("invalid handshake acknowledgement")
+
+func (c *Client) handshakeUDP(rc *net.UDPConn, step int64, secret []byte) (*secure.PacketCodec, error) {
+    priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil { return nil, err }
+    h := auth.NewKeyExchangeHeader(secret, step, c.cfg.ClientID, priv.PublicKey().Bytes(), c.cfg.Suite)
+    if _, err := rc.Write(h.Marshal()); err != nil { return nil, err }
+    reply := make([]byte, 512)
+    rc.SetReadDeadline(time.Now().Add(3 * time.Second))
+    n, err := rc.Read(reply)
+    if err != nil { return nil, err }
+    rc.SetReadDeadline(time.Time{})
+    c2s, s2c, err := c.finishKeyExchange(secret, priv, h, reply[:n])
+    if err != nil { return nil, err }
+    return secure.NewPacketCodec(h.Nonce[:secure.SessionIDLen], c2s, s2c)
+}
+
+// handshakeUDPv1 sends the version 1 header with the first datagram on rc and
+// waits for the server to confirm it. It returns the payload codec, or nil
+// when payload encryption is disabled.
+func (c *Client) handshakeUDPv1(rc *net.UDPConn, step int64, secret, data []byte) (*secure.PacketCodec, error) {
+    h := auth.NewHeader(secret, step, c.cfg.ClientID, c.cfg.Suite, c.headerFlags())
+    payload := h.Marshal()
+    var codec *secure.PacketCodec
+    if c.cfg.Encryption != "none" {
+        c2s, s2c := auth.SessionKeys(secret, step, h.Nonce, c.cfg.ClientID)
+        var err error
+        if codec, err = secure.NewPacketCodec(h.Nonce[:secure.SessionIDLen], c2s, s2c); err != nil { return nil, err }
+        payload = codec.Seal(payload, data)
+    } else {
+        payload = append(payload, data...)
+    }
+    if _, err := rc.Write(payload); err != nil { return nil, err }
+    reply := make([]byte, 512)
+    rc.SetReadDeadline(time.Now().Add(3 * time.Second))
+    defer rc.SetReadDeadline(time.Time{})
+    for {
+        n, err := rc.Read(reply)
+        if err != nil { return nil, err }
+        if n == auth.AckLen && auth.VerifyAck(secret, h, reply[:n]) { return codec, nil }
+    }
+}
+
 type udpClientSession struct {
     remote *net.UDPConn
     src *net.UDPAddr
+    codec *secure.PacketCodec
+    // 握手完成前到达的本地数据报暂存于此
+    pending [][]byte
+    ready bool
 }
 
+// 握手期间每个来源最多暂存的数据报数量
+const udpPendingMax = 64
+
 func (c *Client) startUDP() error {
     laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(c.cfg.BindIP, itoa(c.cfg.BindPort)))
     if err != nil { return err }
     lc, err := net.ListenUDP("udp", laddr)
     if err != nil { return err }
     if c.name != "" { log.Printf("[%s] 客户端本地监听(UDP): %s:%d", c.name, c.cfg.BindIP, c.cfg.BindPort) } else { log.Printf("客户端本地监听(UDP): %s:%d", c.cfg.BindIP, c.cfg.BindPort) }
+    var mu sync.Mutex
     sessions := map[string]*udpClientSession{}
     buf := make([]byte, 65535)
+    var out []byte
     for {
         n, srcAddr, err := lc.ReadFromUDP(buf)
         if err != nil { return err }
         key := srcAddr.String()
+        mu.Lock()
         sess := sessions[key]
         if sess == nil {
-            step := porthop.StepIndex(time.Now(), c.cfg.StepSeconds)
-            rc, sp, err := c.dialServerUDP(step, c.cfg.ServerHost)
-            if err != nil { continue }
-            sess = &udpClientSession{remote: rc, src: srcAddr}
+            sess = &udpClientSession{src: srcAddr}
             sessions[key] = sess
-            nonce, token := auth.Issue(c.secret, step, c.cfg.ClientID)
-            var hdr [8 + 16 + 32]byte
-            binary.BigEndian.PutUint64(hdr[0:8], uint64(step))
-            copy(hdr[8:24], nonce)
-            copy(hdr[24:56], token)
-            payload := append(hdr[:], buf[:n]...)
-            rc.Write(payload)
-            if c.name != "" { log.Printf("[%s] 客户端建立UDP转发: 来源=%s 服务器=%s 使用端口=%d step=%d", c.name, srcAddr.String(), c.cfg.ServerHost, sp, step) } else { log.Printf("客户端建立UDP转发: 来源=%s 服务器=%s 使用端口=%d step=%d", srcAddr.String(), c.cfg.ServerHost, sp, step) }
+            mu.Unlock()
+            first := append([]byte(nil), buf[:n]...)
+            // 拨号与握手可能逐个端点等待确认，放到独立协程中，避免阻塞其他来源
             go func(s *udpClientSession) {
+                if !c.openUDPSession(s, first, &mu) {
+                    mu.Lock()
+                    delete(sessions, key)
+                    mu.Unlock()
+                    return
+                }
                 rbuf := make([]byte, 65535)
                 for {
                     rn, _, rerr := s.remote.ReadFromUDP(rbuf)
                     if rerr != nil { return }
+                    if s.codec != nil {
+                        plain, oerr := s.codec.Open(rbuf[:rn])
+                        if oerr != nil { continue }
+                        lc.WriteToUDP(plain, s.src)
+                        continue
+                    }
                     lc.WriteToUDP(rbuf[:rn], s.src)
                 }
             }(sess)
             continue
         }
+        if !sess.ready {
+            if len(sess.pending) < udpPendingMax { sess.pending = append(sess.pending, append([]byte(nil), buf[:n]...)) }
+            mu.Unlock()
+            continue
+        }
+        mu.Unlock()
+        if sess.codec != nil {
+            out = sess.codec.Seal(out[:0], buf[:n])
+            sess.remote.Write(out)
+            continue
+        }
         sess.remote.Write(buf[:n])
     }
 }
 
-func (c *Client) dialServerUDP(step int64, host string) (*net.UDPConn, int, error) {
-    prev, curr, next := porthop.Triplet(c.secret, step, c.cfg.PortRange.Min, c.cfg.PortRange.Max)
-    ports := porthop.UniquePorts([]int{curr, prev, next})
-    for _, p := range ports {
-        raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, itoa(p)))
+// openUDPSession 为本地来源拨号并完成握手，随后在锁内转发暂存的数据报并将会话标记为就绪。
+func (c *Client) openUDPSession(sess *udpClientSession, first []byte, mu *sync.Mutex) bool {
+    now := c.now()
+    step := porthop.StepIndex(now, c.cfg.StepDuration)
+    sec, hop := c.secretsAt(now)
+    rc, host, sp, eps, err := c.dialServerUDP(c.candidateEndpoints(step, hop))
+    if err != nil { return false }
+    var codec *secure.PacketCodec
+    for {
+        if c.cfg.ForwardSecrecy {
+            codec, err = c.handshakeUDP(rc, step, sec)
+        } else {
+            codec, err = c.handshakeUDPv1(rc, step, sec, first)
+        }
+        if err == nil { break }
+        if c.name != "" { log.Printf("[%s] 客户端UDP握手失败: 服务器=%s 使用端口=%d 错误=%v", c.name, host, sp, err) } else { log.Printf("客户端UDP握手失败: 服务器=%s 使用端口=%d 错误=%v", host, sp, err) }
+        rc.Close()
+        if rc, host, sp, eps, err = c.dialServerUDP(eps); err != nil { return false }
+    }
+    mu.Lock()
+    sess.remote = rc
+    sess.codec = codec
+    if c.cfg.ForwardSecrecy { rc.Write(codec.Seal(nil, first)) }
+    for _, d := range sess.pending {
+        if codec != nil { rc.Write(codec.Seal(nil, d)) } else { rc.Write(d) }
+    }
+    sess.pending = nil
+    sess.ready = true
+    mu.Unlock()
+    if c.name != "" { log.Printf("[%s] 客户端建立UDP转发: 来源=%s 服务器=%s 使用端口=%d step=%d", c.name, sess.src.String(), host, sp, step) } else { log.Printf("客户端建立UDP转发: 来源=%s 服务器=%s 使用端口=%d step=%d", sess.src.String(), host, sp, step) }
+    return true
+}
+
+func (c *Client) dialServerUDP(eps []porthop.Endpoint) (*net.UDPConn, string, int, []porthop.Endpoint, error) {
+    for i, e := range eps {
+        host := c.cfg.ServerHosts[e.Addr]
+        raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, itoa(e.Port)))
         if err != nil { continue }
         conn, err := net.DialUDP("udp", nil, raddr)
-        if err == nil { return conn, p, nil }
+        if err == nil { return conn, host, e.Port, eps[i+1:], nil }
     }
-    return nil, 0, net.ErrClosed
+    return nil, "", 0, nil, net.ErrClosed
 }
\ No newline at end of file
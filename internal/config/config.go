@@ -3,10 +3,15 @@ package config
 import (
     "encoding/json"
     "errors"
+    "net"
+    "net/netip"
     "os"
     "path/filepath"
     "strconv"
     "strings"
+    "time"
+    "okaroute/internal/auth"
+    "okaroute/internal/porthop"
     "github.com/BurntSushi/toml"
     "gopkg.in/yaml.v3"
 )
@@ -15,11 +20,16 @@ type TLSConfig struct {
     Enabled bool   `json:"enabled" yaml:"enabled" toml:"enabled"`
     CertFile string `json:"cert_file" yaml:"cert_file" toml:"cert_file"`
     KeyFile string `json:"key_file" yaml:"key_file" toml:"key_file"`
+    ClientCAFile string `json:"client_ca_file" yaml:"client_ca_file" toml:"client_ca_file"`
 }
 
 type ClientTLSConfig struct {
     Enabled bool `json:"enabled" yaml:"enabled" toml:"enabled"`
     InsecureSkipVerify bool `json:"insecure_skip_verify" yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+    ServerName string `json:"server_name" yaml:"server_name" toml:"server_name"`
+    CAFile string `json:"ca_file" yaml:"ca_file" toml:"ca_file"`
+    CertFile string `json:"cert_file" yaml:"cert_file" toml:"cert_file"`
+    KeyFile string `json:"key_file" yaml:"key_file" toml:"key_file"`
 }
 
 type PortRange struct {
@@ -27,31 +37,128 @@ type PortRange struct {
     Max int `json:"max" yaml:"max" toml:"max"`
 }
 
+type ClientEntry struct {
+    ID string `json:"id" yaml:"id" toml:"id"`
+    Secret string `json:"secret" yaml:"secret" toml:"secret"`
+    HopSecret string `json:"hop_secret" yaml:"hop_secret" toml:"hop_secret"`
+}
+
+type WeightedPort struct {
+    Port int `json:"port" yaml:"port" toml:"port"`
+    Weight int `json:"weight" yaml:"weight" toml:"weight"`
+}
+
+type SecretVersion struct {
+    Secret string `json:"secret" yaml:"secret" toml:"secret"`
+    Activate string `json:"activate" yaml:"activate" toml:"activate"`
+    Expire string `json:"expire" yaml:"expire" toml:"expire"`
+    ActivateAt time.Time `json:"-" yaml:"-" toml:"-"`
+    ExpireAt time.Time `json:"-" yaml:"-" toml:"-"`
+}
+
+type BanConfig struct {
+    MaxFailures int `json:"max_failures" yaml:"max_failures" toml:"max_failures"`
+    WindowSeconds int `json:"window_seconds" yaml:"window_seconds" toml:"window_seconds"`
+    BanSeconds int `json:"ban_seconds" yaml:"ban_seconds" toml:"ban_seconds"`
+    Allowlist []string `json:"allowlist" yaml:"allowlist" toml:"allowlist"`
+    AllowPrefixes []netip.Prefix `json:"-" yaml:"-" toml:"-"`
+}
+
+type KnockConfig struct {
+    Enabled bool `json:"enabled" yaml:"enabled" toml:"enabled"`
+    Count int `json:"count" yaml:"count" toml:"count"`
+    WindowSeconds int `json:"window_seconds" yaml:"window_seconds" toml:"window_seconds"`
+}
+
 type ServerConfig struct {
     Name string `json:"name" yaml:"name" toml:"name"`
     ListenIP string `json:"listen_ip" yaml:"listen_ip" toml:"listen_ip"`
+    ListenIPs []string `json:"listen_ips" yaml:"listen_ips" toml:"listen_ips"`
     PortRange PortRange `json:"port_range" yaml:"port_range" toml:"port_range"`
+    PortRanges []PortRange `json:"port_ranges" yaml:"port_ranges" toml:"port_ranges"`
+    Ports []int `json:"ports" yaml:"ports" toml:"ports"`
+    ExcludePorts []int `json:"exclude_ports" yaml:"exclude_ports" toml:"exclude_ports"`
+    PortSet porthop.PortSet `json:"-" yaml:"-" toml:"-"`
     Protocol string `json:"protocol" yaml:"protocol" toml:"protocol"`
     TOTPSecret string `json:"totp_secret" yaml:"totp_secret" toml:"totp_secret"`
+    Secrets []SecretVersion `json:"secrets" yaml:"secrets" toml:"secrets"`
     StepSeconds int `json:"step_seconds" yaml:"step_seconds" toml:"step_seconds"`
+    Step string `json:"step" yaml:"step" toml:"step"`
+    StepDuration time.Duration `json:"-" yaml:"-" toml:"-"`
     SkewSteps int `json:"skew_steps" yaml:"skew_steps" toml:"skew_steps"`
+    WindowBefore *int `json:"window_before" yaml:"window_before" toml:"window_before"`
+    WindowAfter *int `json:"window_after" yaml:"window_after" toml:"window_after"`
+    WindowBeforeSteps int `json:"-" yaml:"-" toml:"-"`
+    WindowAfterSteps int `json:"-" yaml:"-" toml:"-"`
+    HopHash string `json:"hop_hash" yaml:"hop_hash" toml:"hop_hash"`
+    MACHash string `json:"mac_hash" yaml:"mac_hash" toml:"mac_hash"`
+    MACLength int `json:"mac_length" yaml:"mac_length" toml:"mac_length"`
+    Suite auth.Suite `json:"-" yaml:"-" toml:"-"`
+    Strategy string `json:"strategy" yaml:"strategy" toml:"strategy"`
+    WeightedPorts []WeightedPort `json:"weighted_ports" yaml:"weighted_ports" toml:"weighted_ports"`
+    HopStrategy porthop.Strategy `json:"-" yaml:"-" toml:"-"`
+    HopAlternates int `json:"hop_alternates" yaml:"hop_alternates" toml:"hop_alternates"`
     TargetAddr string `json:"target_addr" yaml:"target_addr" toml:"target_addr"`
     TargetPort int `json:"target_port" yaml:"target_port" toml:"target_port"`
     AllowedCIDRs []string `json:"allowed_client_ips" yaml:"allowed_client_ips" toml:"allowed_client_ips"`
+    AllowedPrefixes []netip.Prefix `json:"-" yaml:"-" toml:"-"`
+    AllowedClientIDs []string `json:"allowed_client_ids" yaml:"allowed_client_ids" toml:"allowed_client_ids"`
+    Clients []ClientEntry `json:"clients" yaml:"clients" toml:"clients"`
+    ReplayCacheSize int `json:"replay_cache_size" yaml:"replay_cache_size" toml:"replay_cache_size"`
+    Encryption string `json:"encryption" yaml:"encryption" toml:"encryption"`
+    InsecureUDP bool `json:"insecure_udp" yaml:"insecure_udp" toml:"insecure_udp"`
+    RequireForwardSecrecy bool `json:"require_forward_secrecy" yaml:"require_forward_secrecy" toml:"require_forward_secrecy"`
+    Ban BanConfig `json:"ban" yaml:"ban" toml:"ban"`
+    HandshakeTimeoutSeconds int `json:"handshake_timeout_seconds" yaml:"handshake_timeout_seconds" toml:"handshake_timeout_seconds"`
+    MaxPreauthConns int `json:"max_preauth_conns" yaml:"max_preauth_conns" toml:"max_preauth_conns"`
+    MaxPreauthPerIP int `json:"max_preauth_per_ip" yaml:"max_preauth_per_ip" toml:"max_preauth_per_ip"`
+    ProbeResponse string `json:"probe_response" yaml:"probe_response" toml:"probe_response"`
+    ProbeHoldSeconds int `json:"probe_hold_seconds" yaml:"probe_hold_seconds" toml:"probe_hold_seconds"`
+    DecoyBanner string `json:"decoy_banner" yaml:"decoy_banner" toml:"decoy_banner"`
+    FallbackAddr string `json:"fallback_addr" yaml:"fallback_addr" toml:"fallback_addr"`
+    Knock KnockConfig `json:"knock" yaml:"knock" toml:"knock"`
+    TimeProbePort int `json:"time_probe_port" yaml:"time_probe_port" toml:"time_probe_port"`
     TLS TLSConfig `json:"tls" yaml:"tls" toml:"tls"`
 }
 
 type ClientConfig struct {
     Name string `json:"name" yaml:"name" toml:"name"`
     ServerHost string `json:"server_host" yaml:"server_host" toml:"server_host"`
+    ServerHosts []string `json:"server_hosts" yaml:"server_hosts" toml:"server_hosts"`
     PortRange PortRange `json:"port_range" yaml:"port_range" toml:"port_range"`
+    PortRanges []PortRange `json:"port_ranges" yaml:"port_ranges" toml:"port_ranges"`
+    Ports []int `json:"ports" yaml:"ports" toml:"ports"`
+    ExcludePorts []int `json:"exclude_ports" yaml:"exclude_ports" toml:"exclude_ports"`
+    PortSet porthop.PortSet `json:"-" yaml:"-" toml:"-"`
     Protocol string `json:"protocol" yaml:"protocol" toml:"protocol"`
     TOTPSecret string `json:"totp_secret" yaml:"totp_secret" toml:"totp_secret"`
+    Secrets []SecretVersion `json:"secrets" yaml:"secrets" toml:"secrets"`
+    HopSecret string `json:"hop_secret" yaml:"hop_secret" toml:"hop_secret"`
     StepSeconds int `json:"step_seconds" yaml:"step_seconds" toml:"step_seconds"`
+    Step string `json:"step" yaml:"step" toml:"step"`
+    StepDuration time.Duration `json:"-" yaml:"-" toml:"-"`
     SkewSteps int `json:"skew_steps" yaml:"skew_steps" toml:"skew_steps"`
+    WindowBefore *int `json:"window_before" yaml:"window_before" toml:"window_before"`
+    WindowAfter *int `json:"window_after" yaml:"window_after" toml:"window_after"`
+    WindowBeforeSteps int `json:"-" yaml:"-" toml:"-"`
+    WindowAfterSteps int `json:"-" yaml:"-" toml:"-"`
+    HopHash string `json:"hop_hash" yaml:"hop_hash" toml:"hop_hash"`
+    MACHash string `json:"mac_hash" yaml:"mac_hash" toml:"mac_hash"`
+    MACLength int `json:"mac_length" yaml:"mac_length" toml:"mac_length"`
+    Suite auth.Suite `json:"-" yaml:"-" toml:"-"`
+    Strategy string `json:"strategy" yaml:"strategy" toml:"strategy"`
+    WeightedPorts []WeightedPort `json:"weighted_ports" yaml:"weighted_ports" toml:"weighted_ports"`
+    HopStrategy porthop.Strategy `json:"-" yaml:"-" toml:"-"`
+    HopAlternates int `json:"hop_alternates" yaml:"hop_alternates" toml:"hop_alternates"`
     BindIP string `json:"bind_ip" yaml:"bind_ip" toml:"bind_ip"`
     BindPort int `json:"bind_port" yaml:"bind_port" toml:"bind_port"`
     ClientID string `json:"client_id" yaml:"client_id" toml:"client_id"`
+    Encryption string `json:"encryption" yaml:"encryption" toml:"encryption"`
+    InsecureUDP bool `json:"insecure_udp" yaml:"insecure_udp" toml:"insecure_udp"`
+    ForwardSecrecy bool `json:"forward_secrecy" yaml:"forward_secrecy" toml:"forward_secrecy"`
+    Knock KnockConfig `json:"knock" yaml:"knock" toml:"knock"`
+    TimeProbePort int `json:"time_probe_port" yaml:"time_probe_port" toml:"time_probe_port"`
+    TimeProbeIntervalSeconds int `json:"time_probe_interval_seconds" yaml:"time_probe_interval_seconds" toml:"time_probe_interval_seconds"`
     TLS ClientTLSConfig `json:"tls" yaml:"tls" toml:"tls"`
 }
 
@@ -72,19 +179,7 @@ func LoadServerConfig(path string) (ServerConfig, error) {
     if err := unmarshalByExt(b, path, &c); err != nil {
         return c, err
     }
-    if c.PortRange.Min <= 0 || c.PortRange.Max <= 0 || c.PortRange.Min > c.PortRange.Max {
-        return c, errors.New("invalid port_range")
-    }
-    if c.Protocol != "tcp" && c.Protocol != "udp" {
-        return c, errors.New("invalid protocol")
-    }
-    if c.StepSeconds <= 0 {
-        return c, errors.New("invalid step_seconds")
-    }
-    if c.TargetAddr == "" || c.TargetPort <= 0 {
-        return c, errors.New("invalid target")
-    }
-    return c, nil
+    return validateServerConfig(&c)
 }
 
 func LoadServerConfigs(path string) ([]ServerConfig, error) {
@@ -106,9 +201,13 @@ func LoadServerConfigs(path string) ([]ServerConfig, error) {
         // check port range overlap among routes
         for i := 0; i < len(multi.Routes); i++ {
             for j := i + 1; j < len(multi.Routes); j++ {
-                if overlap(multi.Routes[i].PortRange, multi.Routes[j].PortRange) {
+                if multi.Routes[i].PortSet.Intersects(multi.Routes[j].PortSet) {
                     return nil, errors.New("server routes port_range overlap detected")
                 }
+                a, b := multi.Routes[i], multi.Routes[j]
+                if a.TimeProbePort > 0 && (a.TimeProbePort == b.TimeProbePort || b.PortSet.Contains(a.TimeProbePort)) || b.TimeProbePort > 0 && a.PortSet.Contains(b.TimeProbePort) {
+                    return nil, errors.New("server routes time_probe_port conflict detected")
+                }
             }
         }
         return multi.Routes, nil
@@ -122,18 +221,154 @@ func LoadServerConfigs(path string) ([]ServerConfig, error) {
 }
 
 func validateServerConfig(c *ServerConfig) (ServerConfig, error) {
-    if c.PortRange.Min <= 0 || c.PortRange.Max <= 0 || c.PortRange.Min > c.PortRange.Max {
-        return *c, errors.New("invalid port_range")
+    set, err := buildPortSet(c.PortRange, c.PortRanges, c.Ports, c.ExcludePorts)
+    if err != nil {
+        return *c, err
     }
+    c.PortSet = set
     if c.Protocol != "tcp" && c.Protocol != "udp" {
         return *c, errors.New("invalid protocol")
     }
-    if c.StepSeconds <= 0 {
-        return *c, errors.New("invalid step_seconds")
+    if err := validateStep(c.Step, c.StepSeconds, &c.StepDuration); err != nil {
+        return *c, err
+    }
+    var suite auth.Suite
+    suite, err = auth.ParseSuite(c.HopHash, c.MACHash, c.MACLength)
+    if err != nil {
+        return *c, err
+    }
+    c.Suite = suite
+    if c.HopStrategy, err = newStrategy(c.Strategy, suite, set, c.WeightedPorts); err != nil {
+        return *c, err
     }
+    if c.HopAlternates == 0 { c.HopAlternates = 2 }
+    if c.HopAlternates < 0 || c.HopAlternates > 8 {
+        return *c, errors.New("invalid hop_alternates")
+    }
+    before, after, err := validateWindow(c.SkewSteps, c.WindowBefore, c.WindowAfter)
+    if err != nil {
+        return *c, err
+    }
+    c.WindowBeforeSteps, c.WindowAfterSteps = before, after
     if c.TargetAddr == "" || c.TargetPort <= 0 {
         return *c, errors.New("invalid target")
     }
+    if err := resolveSecret("totp_secret", &c.TOTPSecret); err != nil {
+        return *c, err
+    }
+    if err := validateSecrets(c.Secrets); err != nil {
+        return *c, err
+    }
+    if c.TLS.Enabled {
+        if c.Protocol != "tcp" {
+            return *c, errors.New("tls requires protocol tcp")
+        }
+        if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+            return *c, errors.New("invalid tls cert_file/key_file")
+        }
+    } else if c.TLS.ClientCAFile != "" {
+        return *c, errors.New("tls client_ca_file requires tls enabled")
+    }
+    for _, id := range c.AllowedClientIDs {
+        if id == "" || len(id) > auth.MaxClientIDLen {
+            return *c, errors.New("invalid allowed_client_ids")
+        }
+    }
+    ids := map[string]struct{}{}
+    for i := range c.Clients {
+        e := &c.Clients[i]
+        if e.ID == "" || len(e.ID) > auth.MaxClientIDLen || e.Secret == "" {
+            return *c, errors.New("invalid clients entry")
+        }
+        if _, ok := ids[e.ID]; ok {
+            return *c, errors.New("clients id duplicated: " + e.ID)
+        }
+        ids[e.ID] = struct{}{}
+        if err := resolveSecret("clients["+e.ID+"].secret", &e.Secret); err != nil {
+            return *c, err
+        }
+        if err := resolveSecret("clients["+e.ID+"].hop_secret", &e.HopSecret); err != nil {
+            return *c, err
+        }
+    }
+    c.AllowedPrefixes = nil
+    for _, v := range c.AllowedCIDRs {
+        p, err := parsePrefix(v)
+        if err != nil {
+            return *c, errors.New("invalid allowed_client_ips entry: " + v)
+        }
+        c.AllowedPrefixes = append(c.AllowedPrefixes, p)
+    }
+    if c.Ban.MaxFailures < 0 || c.Ban.WindowSeconds < 0 || c.Ban.BanSeconds < 0 {
+        return *c, errors.New("invalid ban")
+    }
+    if c.Ban.WindowSeconds == 0 { c.Ban.WindowSeconds = 60 }
+    if c.Ban.BanSeconds == 0 { c.Ban.BanSeconds = 600 }
+    c.Ban.AllowPrefixes = nil
+    for _, v := range c.Ban.Allowlist {
+        p, err := parsePrefix(v)
+        if err != nil {
+            return *c, errors.New("invalid ban allowlist entry: " + v)
+        }
+        c.Ban.AllowPrefixes = append(c.Ban.AllowPrefixes, p)
+    }
+    if c.HandshakeTimeoutSeconds < 0 || c.MaxPreauthConns < 0 || c.MaxPreauthPerIP < 0 {
+        return *c, errors.New("invalid handshake_timeout_seconds/max_preauth_conns/max_preauth_per_ip")
+    }
+    if c.HandshakeTimeoutSeconds == 0 { c.HandshakeTimeoutSeconds = 10 }
+    if c.MaxPreauthConns == 0 { c.MaxPreauthConns = 1024 }
+    if c.MaxPreauthPerIP == 0 { c.MaxPreauthPerIP = 64 }
+    switch c.ProbeResponse {
+    case "":
+        c.ProbeResponse = "close"
+    case "close", "hold", "reset":
+    case "decoy":
+        if c.DecoyBanner == "" {
+            return *c, errors.New("probe_response decoy requires decoy_banner")
+        }
+    default:
+        return *c, errors.New("invalid probe_response")
+    }
+    if c.FallbackAddr != "" {
+        if c.Protocol != "tcp" {
+            return *c, errors.New("fallback_addr requires protocol tcp")
+        }
+        if _, _, err := net.SplitHostPort(c.FallbackAddr); err != nil {
+            return *c, errors.New("invalid fallback_addr")
+        }
+    }
+    if err := validateKnock(&c.Knock, c.Protocol, c.PortSet); err != nil {
+        return *c, err
+    }
+    if len(c.ListenIPs) == 0 {
+        c.ListenIPs = []string{c.ListenIP}
+    } else {
+        seen := map[netip.Addr]struct{}{}
+        for _, v := range c.ListenIPs {
+            ip, err := netip.ParseAddr(v)
+            if err != nil {
+                return *c, errors.New("invalid listen_ips entry: " + v)
+            }
+            if _, ok := seen[ip]; ok {
+                return *c, errors.New("listen_ips duplicated: " + v)
+            }
+            seen[ip] = struct{}{}
+        }
+    }
+    if c.TimeProbePort < 0 || c.TimeProbePort > 65535 || c.PortSet.Contains(c.TimeProbePort) {
+        return *c, errors.New("invalid time_probe_port")
+    }
+    if c.ProbeHoldSeconds < 0 {
+        return *c, errors.New("invalid probe_hold_seconds")
+    }
+    if c.ProbeHoldSeconds == 0 { c.ProbeHoldSeconds = 30 }
+    if c.ReplayCacheSize < 0 {
+        return *c, errors.New("invalid replay_cache_size")
+    }
+    if c.ReplayCacheSize == 0 { c.ReplayCacheSize = 65536 }
+    if err := validateEncryption(&c.Encryption, c.Protocol, c.InsecureUDP); err != nil {
+        return *c, err
+    }
     return *c, nil
 }
 
@@ -146,25 +381,7 @@ func LoadClientConfig(path string) (ClientConfig, error) {
     if err := unmarshalByExt(b, path, &c); err != nil {
         return c, err
     }
-    if c.PortRange.Min <= 0 || c.PortRange.Max <= 0 || c.PortRange.Min > c.PortRange.Max {
-        return c, errors.New("invalid port_range")
-    }
-    if c.Protocol != "tcp" && c.Protocol != "udp" {
-        return c, errors.New("invalid protocol")
-    }
-    if c.StepSeconds <= 0 {
-        return c, errors.New("invalid step_seconds")
-    }
-    if c.BindPort <= 0 {
-        return c, errors.New("invalid bind_port")
-    }
-    if c.ServerHost == "" {
-        return c, errors.New("invalid server_host")
-    }
-    if c.ClientID == "" {
-        c.ClientID = "client"
-    }
-    return c, nil
+    return validateClientConfig(&c)
 }
 
 func LoadClientConfigs(path string) ([]ClientConfig, error) {
@@ -192,25 +409,276 @@ func LoadClientConfigs(path string) ([]ClientConfig, error) {
 }
 
 func validateClientConfig(c *ClientConfig) (ClientConfig, error) {
-    if c.PortRange.Min <= 0 || c.PortRange.Max <= 0 || c.PortRange.Min > c.PortRange.Max {
-        return *c, errors.New("invalid port_range")
+    set, err := buildPortSet(c.PortRange, c.PortRanges, c.Ports, c.ExcludePorts)
+    if err != nil {
+        return *c, err
     }
+    c.PortSet = set
     if c.Protocol != "tcp" && c.Protocol != "udp" {
         return *c, errors.New("invalid protocol")
     }
-    if c.StepSeconds <= 0 {
-        return *c, errors.New("invalid step_seconds")
+    if err := validateStep(c.Step, c.StepSeconds, &c.StepDuration); err != nil {
+        return *c, err
     }
+    var suite auth.Suite
+    suite, err = auth.ParseSuite(c.HopHash, c.MACHash, c.MACLength)
+    if err != nil {
+        return *c, err
+    }
+    c.Suite = suite
+    if c.HopStrategy, err = newStrategy(c.Strategy, suite, set, c.WeightedPorts); err != nil {
+        return *c, err
+    }
+    if c.HopAlternates == 0 { c.HopAlternates = 2 }
+    if c.HopAlternates < 0 || c.HopAlternates > 8 {
+        return *c, errors.New("invalid hop_alternates")
+    }
+    before, after, err := validateWindow(c.SkewSteps, c.WindowBefore, c.WindowAfter)
+    if err != nil {
+        return *c, err
+    }
+    c.WindowBeforeSteps, c.WindowAfterSteps = before, after
     if c.BindPort <= 0 {
         return *c, errors.New("invalid bind_port")
     }
-    if c.ServerHost == "" {
-        return *c, errors.New("invalid server_host")
+    if len(c.ServerHosts) == 0 {
+        if c.ServerHost == "" {
+            return *c, errors.New("invalid server_host")
+        }
+        c.ServerHosts = []string{c.ServerHost}
+    }
+    for _, h := range c.ServerHosts {
+        if h == "" {
+            return *c, errors.New("invalid server_hosts entry")
+        }
+    }
+    if err := resolveSecret("totp_secret", &c.TOTPSecret); err != nil {
+        return *c, err
+    }
+    if err := validateSecrets(c.Secrets); err != nil {
+        return *c, err
+    }
+    if err := resolveSecret("hop_secret", &c.HopSecret); err != nil {
+        return *c, err
     }
     if c.ClientID == "" { c.ClientID = "client" }
+    if len(c.ClientID) > auth.MaxClientIDLen {
+        return *c, errors.New("invalid client_id")
+    }
+    if c.TLS.Enabled && c.Protocol != "tcp" {
+        return *c, errors.New("tls requires protocol tcp")
+    }
+    if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+        return *c, errors.New("invalid tls cert_file/key_file")
+    }
+    if err := validateEncryption(&c.Encryption, c.Protocol, c.InsecureUDP); err != nil {
+        return *c, err
+    }
+    if c.ForwardSecrecy && c.Encryption != "aes-256-gcm" {
+        return *c, errors.New("forward_secrecy requires encryption aes-256-gcm")
+    }
+    if err := validateKnock(&c.Knock, c.Protocol, c.PortSet); err != nil {
+        return *c, err
+    }
+    if c.TimeProbePort < 0 || c.TimeProbePort > 65535 {
+        return *c, errors.New("invalid time_probe_port")
+    }
+    if c.TimeProbeIntervalSeconds <= 0 { c.TimeProbeIntervalSeconds = 300 }
     return *c, nil
 }
 
+func newStrategy(name string, suite auth.Suite, set porthop.PortSet, weighted []WeightedPort) (porthop.Strategy, error) {
+    if len(weighted) > 0 && name != "weighted" {
+        return nil, errors.New("weighted_ports requires strategy weighted")
+    }
+    list := make([]porthop.WeightedPort, 0, len(weighted))
+    for _, w := range weighted {
+        if !set.Contains(w.Port) {
+            return nil, errors.New("weighted_ports must lie within the route's ports")
+        }
+        list = append(list, porthop.WeightedPort{Port: w.Port, Weight: w.Weight})
+    }
+    return porthop.NewStrategy(name, suite.Hop, set, list)
+}
+
+// buildPortSet merges port_range, port_ranges and ports into one set and
+// removes exclude_ports. Ranges may not overlap each other and explicit
+// ports may not repeat or fall inside a range.
+func buildPortSet(r PortRange, ranges []PortRange, ports, exclude []int) (porthop.PortSet, error) {
+    if r != (PortRange{}) {
+        ranges = append([]PortRange{r}, ranges...)
+    }
+    if len(ranges) == 0 && len(ports) == 0 {
+        return nil, errors.New("invalid port_range")
+    }
+    for i, a := range ranges {
+        if a.Min <= 0 || a.Max > 65535 || a.Min > a.Max {
+            return nil, errors.New("invalid port_range")
+        }
+        for _, b := range ranges[:i] {
+            if overlap(a, b) {
+                return nil, errors.New("port ranges overlap: " + strconv.Itoa(a.Min) + "-" + strconv.Itoa(a.Max))
+            }
+        }
+    }
+    var all []int
+    seen := map[int]struct{}{}
+    for _, p := range ports {
+        if p <= 0 || p > 65535 {
+            return nil, errors.New("invalid ports entry")
+        }
+        if _, ok := seen[p]; ok {
+            return nil, errors.New("ports duplicated: " + strconv.Itoa(p))
+        }
+        seen[p] = struct{}{}
+        for _, a := range ranges {
+            if p >= a.Min && p <= a.Max {
+                return nil, errors.New("ports entry " + strconv.Itoa(p) + " overlaps port range")
+            }
+        }
+        all = append(all, p)
+    }
+    excluded := map[int]struct{}{}
+    for _, p := range exclude {
+        if p <= 0 || p > 65535 {
+            return nil, errors.New("invalid exclude_ports entry")
+        }
+        excluded[p] = struct{}{}
+    }
+    for _, a := range ranges {
+        for p := a.Min; p <= a.Max; p++ {
+            all = append(all, p)
+        }
+    }
+    set := all[:0]
+    for _, p := range all {
+        if _, ok := excluded[p]; !ok { set = append(set, p) }
+    }
+    if len(set) == 0 {
+        return nil, errors.New("no ports left after exclude_ports")
+    }
+    return porthop.NewPortSet(set), nil
+}
+
+// MinStep is the shortest hop step accepted from config.
+const MinStep = 10 * time.Millisecond
+
+// validateStep resolves the hop step from step (a duration such as "500ms")
+// or the integer step_seconds. When both are set they must agree.
+func validateStep(step string, seconds int, d *time.Duration) error {
+    if step == "" {
+        if seconds <= 0 {
+            return errors.New("invalid step_seconds")
+        }
+        *d = time.Duration(seconds) * time.Second
+        return nil
+    }
+    v, err := time.ParseDuration(step)
+    if err != nil || v < MinStep || v%time.Millisecond != 0 {
+        return errors.New("invalid step")
+    }
+    if seconds > 0 && time.Duration(seconds)*time.Second != v {
+        return errors.New("step and step_seconds disagree")
+    }
+    *d = v
+    return nil
+}
+
+// validateWindow checks skew_steps and resolves window_before/window_after,
+// which default to skew_steps. A side wider than skew_steps is refused: its
+// ports would only ever see handshakes that fail the skew check.
+func validateWindow(skew int, before, after *int) (int, int, error) {
+    if skew < 0 || skew > 32 {
+        return 0, 0, errors.New("invalid skew_steps")
+    }
+    b, a := skew, skew
+    if before != nil { b = *before }
+    if after != nil { a = *after }
+    if b < 0 || b > 32 || a < 0 || a > 32 {
+        return 0, 0, errors.New("invalid window_before/window_after")
+    }
+    if b > skew || a > skew {
+        return 0, 0, errors.New("window_before/window_after must not exceed skew_steps")
+    }
+    return b, a, nil
+}
+
+func validateSecrets(list []SecretVersion) error {
+    for i := range list {
+        v := &list[i]
+        field := "secrets[" + strconv.Itoa(i) + "]"
+        if v.Secret == "" {
+            return errors.New("invalid " + field + ": missing secret")
+        }
+        if err := resolveSecret(field+".secret", &v.Secret); err != nil {
+            return err
+        }
+        var err error
+        v.ActivateAt, v.ExpireAt = time.Time{}, time.Time{}
+        if v.Activate != "" {
+            if v.ActivateAt, err = time.Parse(time.RFC3339, v.Activate); err != nil {
+                return errors.New("invalid " + field + ".activate: " + err.Error())
+            }
+        }
+        if v.Expire != "" {
+            if v.ExpireAt, err = time.Parse(time.RFC3339, v.Expire); err != nil {
+                return errors.New("invalid " + field + ".expire: " + err.Error())
+            }
+        }
+        if !v.ActivateAt.IsZero() && !v.ExpireAt.IsZero() && !v.ExpireAt.After(v.ActivateAt) {
+            return errors.New("invalid " + field + ": expire must be after activate")
+        }
+    }
+    return nil
+}
+
+func validateKnock(k *KnockConfig, protocol string, ports porthop.PortSet) error {
+    if !k.Enabled { return nil }
+    if protocol != "tcp" {
+        return errors.New("knock requires protocol tcp")
+    }
+    if k.Count < 0 || k.Count > 16 || k.WindowSeconds < 0 {
+        return errors.New("invalid knock")
+    }
+    if k.Count == 0 { k.Count = 3 }
+    if k.WindowSeconds == 0 { k.WindowSeconds = 30 }
+    if k.Count > len(ports) {
+        return errors.New("knock count exceeds the route's ports")
+    }
+    return nil
+}
+
+// validateEncryption defaults encryption to none for TCP and to aes-256-gcm
+// for UDP. Unsealed UDP sessions are keyed by source address only, so they
+// are refused unless insecure_udp is set.
+func validateEncryption(enc *string, protocol string, insecureUDP bool) error {
+    switch *enc {
+    case "":
+        *enc = "none"
+        if protocol == "udp" && !insecureUDP { *enc = "aes-256-gcm" }
+    case "none":
+        if protocol == "udp" && !insecureUDP {
+            return errors.New("protocol udp requires encryption aes-256-gcm (set insecure_udp to allow none)")
+        }
+    case "aes-256-gcm":
+    default:
+        return errors.New("invalid encryption")
+    }
+    return nil
+}
+
+func parsePrefix(v string) (netip.Prefix, error) {
+    v = strings.TrimSpace(v)
+    if strings.Contains(v, "/") {
+        p, err := netip.ParsePrefix(v)
+        if err != nil { return p, err }
+        return p.Masked(), nil
+    }
+    a, err := netip.ParseAddr(v)
+    if err != nil { return netip.Prefix{}, err }
+    return netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()), nil
+}
+
 func overlap(a, b PortRange) bool {
     if a.Max < a.Min || b.Max < b.Min { return false }
     return !(a.Max < b.Min || b.Max < a.Min)
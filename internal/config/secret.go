@@ -0,0 +1,55 @@
+package config
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+    "okaroute/internal/porthop"
+)
+
+const secretExecTimeout = 10 * time.Second
+
+// resolveSecret expands a secret reference in place. Values of the form
+// env:NAME, file:PATH and exec:COMMAND are replaced by the variable, the file
+// contents or the command's stdout; anything else is taken as an inline
+// base32 secret. The result is checked with porthop.DecodeSecretFrom so a bad
+// value is reported by its source rather than by its contents.
+func resolveSecret(field string, v *string) error {
+    if *v == "" { return nil }
+    source := "inline"
+    val := *v
+    switch {
+    case strings.HasPrefix(val, "env:"):
+        name := strings.TrimPrefix(val, "env:")
+        source = val
+        s, ok := os.LookupEnv(name)
+        if !ok { return errors.New(field + ": " + source + " is not set") }
+        val = s
+    case strings.HasPrefix(val, "file:"):
+        source = val
+        b, err := os.ReadFile(strings.TrimPrefix(val, "file:"))
+        if err != nil { return errors.New(field + ": " + source + ": " + err.Error()) }
+        val = string(b)
+    case strings.HasPrefix(val, "exec:"):
+        args := strings.Fields(strings.TrimPrefix(val, "exec:"))
+        if len(args) == 0 { return errors.New(field + ": empty exec command") }
+        source = "exec:" + args[0]
+        ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+        defer cancel()
+        var out bytes.Buffer
+        cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+        cmd.Stdout = &out
+        cmd.Stderr = os.Stderr
+        if err := cmd.Run(); err != nil { return errors.New(field + ": " + source + ": " + err.Error()) }
+        val = out.String()
+    }
+    val = strings.TrimSpace(val)
+    if val == "" { return errors.New(field + ": " + source + " is empty") }
+    if _, err := porthop.DecodeSecretFrom(source, val); err != nil { return errors.New(field + ": " + err.Error()) }
+    *v = val
+    return nil
+}
\ No newline at end of file
@@ -22,12 +22,23 @@ func pipe(a, b net.Conn) {
 }
 
 func HandleTCP(conn net.Conn, target string) {
+    Splice(conn, target, nil)
+}
+
+func Splice(conn net.Conn, target string, prefix []byte) {
     conn.SetDeadline(time.Now().Add(90 * time.Second))
     dst, err := net.Dial("tcp", target)
     if err != nil {
         conn.Close()
         return
     }
+    if len(prefix) > 0 {
+        if _, err := dst.Write(prefix); err != nil {
+            conn.Close()
+            dst.Close()
+            return
+        }
+    }
     conn.SetDeadline(time.Time{})
     dst.SetDeadline(time.Time{})
     pipe(conn, dst)
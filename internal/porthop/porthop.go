@@ -1,8 +1,11 @@
 package porthop
 
 import (
+    "crypto"
     "crypto/hmac"
-    "crypto/sha1"
+    _ "crypto/sha1"
+    "crypto/sha256"
+    _ "crypto/sha512"
     "encoding/base32"
     "encoding/binary"
     "math"
@@ -10,19 +13,44 @@ import (
     "time"
 )
 
+// SecretError reports a secret that failed to decode. It names where the
+// secret came from but never carries the secret itself.
+type SecretError struct {
+    Source string
+    Err error
+}
+
+func (e *SecretError) Error() string { return "invalid secret from " + e.Source + ": " + e.Err.Error() }
+
+func (e *SecretError) Unwrap() error { return e.Err }
+
 func DecodeSecret(base32Str string) ([]byte, error) {
+    return DecodeSecretFrom("inline", base32Str)
+}
+
+// DecodeSecretFrom decodes base32Str, labelling any error with source
+// (e.g. "env:OKAROUTE_SECRET").
+func DecodeSecretFrom(source, base32Str string) ([]byte, error) {
     d := base32.StdEncoding.WithPadding(base32.NoPadding)
-    return d.DecodeString(strings.ToUpper(base32Str))
+    b, err := d.DecodeString(strings.ToUpper(base32Str))
+    if err != nil { return nil, &SecretError{Source: source, Err: err} }
+    return b, nil
 }
 
-func StepIndex(now time.Time, stepSeconds int) int64 {
-    return now.Unix() / int64(stepSeconds)
+// StepIndex returns the index of the step containing now, counted in
+// millisecond precision from the Unix epoch. For whole-second steps this
+// equals now.Unix() divided by the step in seconds.
+func StepIndex(now time.Time, step time.Duration) int64 {
+    ms := now.UnixMilli()
+    n := step.Milliseconds()
+    if ms < 0 { return (ms - n + 1) / n }
+    return ms / n
 }
 
-func totp(secret []byte, step int64) uint32 {
+func totp(hash crypto.Hash, secret []byte, step int64) uint32 {
     var b [8]byte
     binary.BigEndian.PutUint64(b[:], uint64(step))
-    h := hmac.New(sha1.New, secret)
+    h := hmac.New(hash.New, secret)
     h.Write(b[:])
     sum := h.Sum(nil)
     off := sum[len(sum)-1] & 0x0f
@@ -30,17 +58,28 @@ func totp(secret []byte, step int64) uint32 {
     return code
 }
 
-func PortForStep(secret []byte, step int64, minPort, maxPort int) int {
-    r := maxPort - minPort + 1
-    c := totp(secret, step)
-    return minPort + int(c%uint32(r))
+func LabelSecret(secret []byte, label string) []byte {
+    h := hmac.New(sha256.New, secret)
+    h.Write([]byte(label))
+    return h.Sum(nil)
 }
 
-func Triplet(secret []byte, step int64, minPort, maxPort int) (int, int, int) {
-    prev := PortForStep(secret, step-1, minPort, maxPort)
-    curr := PortForStep(secret, step, minPort, maxPort)
-    next := PortForStep(secret, step+1, minPort, maxPort)
-    return prev, curr, next
+// KnockPorts returns the count distinct knock ports for step. An index whose
+// derived port is already taken moves to the next free port of the set, so
+// both peers get the same sequence. ports must hold at least count ports.
+func KnockPorts(hash crypto.Hash, knockSecret []byte, step int64, count int, ports PortSet) []int {
+    out := make([]int, 0, count)
+    used := map[int]struct{}{}
+    for i := 0; i < count; i++ {
+        j := int(totp(hash, knockSecret, step*int64(count)+int64(i)) % uint32(len(ports)))
+        for {
+            if _, ok := used[j]; !ok { break }
+            j = (j + 1) % len(ports)
+        }
+        used[j] = struct{}{}
+        out = append(out, ports[j])
+    }
+    return out
 }
 
 func UniquePorts(ports []int) []int {
@@ -55,11 +94,9 @@ func UniquePorts(ports []int) []int {
     return res
 }
 
-func NextRotation(now time.Time, stepSeconds int) time.Duration {
-    s := StepIndex(now, stepSeconds)
-    base := s * int64(stepSeconds)
-    next := base + int64(stepSeconds)
-    return time.Duration(next-now.Unix()) * time.Second
+func NextRotation(now time.Time, step time.Duration) time.Duration {
+    s := StepIndex(now, step)
+    return time.UnixMilli((s + 1) * step.Milliseconds()).Sub(now)
 }
 
 func ClampSkew(step int64, current int64, skew int) bool {
@@ -0,0 +1,198 @@
+package porthop
+
+import (
+    "crypto"
+    "crypto/hmac"
+    "encoding/binary"
+    "errors"
+    "math"
+    "math/bits"
+    "sort"
+    "strconv"
+)
+
+// PortSet is the sorted list of distinct ports a route hops over.
+type PortSet []int
+
+// NewPortSet sorts and de-duplicates ports.
+func NewPortSet(ports []int) PortSet {
+    set := PortSet(UniquePorts(ports))
+    sort.Ints(set)
+    return set
+}
+
+func (p PortSet) Contains(port int) bool {
+    i := sort.SearchInts(p, port)
+    return i < len(p) && p[i] == port
+}
+
+// Intersects reports whether p and q share a port.
+func (p PortSet) Intersects(q PortSet) bool {
+    i, j := 0, 0
+    for i < len(p) && j < len(q) {
+        switch {
+        case p[i] == q[j]:
+            return true
+        case p[i] < q[j]:
+            i++
+        default:
+            j++
+        }
+    }
+    return false
+}
+
+// Strategy maps a hop secret and step index to a listening port.
+type Strategy interface {
+    // Port returns the port for step.
+    Port(secret []byte, step int64) int
+}
+
+type WeightedPort struct {
+    Port int
+    Weight int
+}
+
+// NewStrategy returns the named strategy over ports: "totp" (the default),
+// "permutation" or "weighted". weighted is only used by the weighted strategy.
+func NewStrategy(name string, hash crypto.Hash, ports PortSet, weighted []WeightedPort) (Strategy, error) {
+    if len(ports) == 0 { return nil, errors.New("empty port set") }
+    switch name {
+    case "", "totp":
+        return TOTP{Hash: hash, Ports: ports}, nil
+    case "permutation":
+        return Permutation{Hash: hash, Ports: ports}, nil
+    case "weighted":
+        return NewWeighted(hash, weighted)
+    }
+    return nil, errors.New("invalid strategy")
+}
+
+// StrategyTriplet returns the previous, current and next port of st around
+// step.
+func StrategyTriplet(st Strategy, secret []byte, step int64) (int, int, int) {
+    return st.Port(secret, step-1), st.Port(secret, step), st.Port(secret, step+1)
+}
+
+// Endpoint is a hop destination: an index into the route's address list and
+// a port.
+type Endpoint struct {
+    Addr int
+    Port int
+}
+
+// AddressIndex picks which of n addresses serves step. It is keyed by its own
+// label so adding addresses leaves the port sequence unchanged.
+func AddressIndex(hash crypto.Hash, secret []byte, step int64, n int) int {
+    if n <= 1 { return 0 }
+    return int(totp(hash, LabelSecret(secret, "okaroute address"), step) % uint32(n))
+}
+
+// Endpoints returns the endpoint st assigns to step among addrs addresses,
+// followed by n alternates for when it cannot be bound. Alternate k is the
+// endpoint for the same step under a secret re-derived from secret and k, so
+// both peers compute the same sequence and an alternate may also move to
+// another address.
+func Endpoints(st Strategy, hash crypto.Hash, secret []byte, step int64, n, addrs int) []Endpoint {
+    eps := []Endpoint{{Addr: AddressIndex(hash, secret, step, addrs), Port: st.Port(secret, step)}}
+    for k := 1; k <= n; k++ {
+        sec := LabelSecret(secret, "okaroute alternate "+strconv.Itoa(k))
+        eps = append(eps, Endpoint{Addr: AddressIndex(hash, sec, step, addrs), Port: st.Port(sec, step)})
+    }
+    return eps
+}
+
+// WindowOrder lists the steps of the window around step nearest first:
+// step, step-1, step+1, step-2, step+2 and so on, bounded by before and after.
+func WindowOrder(step int64, before, after int) []int64 {
+    steps := []int64{step}
+    for k := 1; k <= before || k <= after; k++ {
+        if k <= before { steps = append(steps, step-int64(k)) }
+        if k <= after { steps = append(steps, step+int64(k)) }
+    }
+    return steps
+}
+
+// TOTP picks the TOTP code of each step modulo the size of the port set.
+type TOTP struct {
+    Hash crypto.Hash
+    Ports PortSet
+}
+
+func (t TOTP) Port(secret []byte, step int64) int {
+    return t.Ports[totp(t.Hash, secret, step)%uint32(len(t.Ports))]
+}
+
+// Permutation walks a keyed permutation of the port set, so within each
+// cycle of len(Ports) consecutive steps no port is used twice. Each cycle
+// draws a fresh permutation.
+type Permutation struct {
+    Hash crypto.Hash
+    Ports PortSet
+}
+
+func (p Permutation) Port(secret []byte, step int64) int {
+    n := int64(len(p.Ports))
+    cycle, pos := step/n, step%n
+    if pos < 0 { cycle, pos = cycle-1, pos+n }
+    mac := hmac.New(p.Hash.New, secret)
+    mac.Write([]byte("okaroute permutation"))
+    mac.Write(binary.BigEndian.AppendUint64(nil, uint64(cycle)))
+    return p.Ports[feistel(p.Hash, mac.Sum(nil), uint32(pos), uint32(n))]
+}
+
+// feistel maps x in [0, n) to a distinct value in [0, n) using a balanced
+// Feistel network over the next even power of two, cycle-walking values that
+// fall outside the domain.
+func feistel(hash crypto.Hash, key []byte, x, n uint32) uint32 {
+    w := bits.Len32(n - 1)
+    if w < 2 { w = 2 }
+    if w%2 == 1 { w++ }
+    half := uint(w / 2)
+    mask := uint32(1)<<half - 1
+    for {
+        l, r := x>>half, x&mask
+        for round := byte(0); round < 4; round++ {
+            mac := hmac.New(hash.New, key)
+            mac.Write([]byte{round})
+            mac.Write(binary.BigEndian.AppendUint32(nil, r))
+            f := binary.BigEndian.Uint32(mac.Sum(nil)) & mask
+            l, r = r, l^f
+        }
+        x = l<<half | r
+        if x < n { return x }
+    }
+}
+
+// Weighted picks among an explicit port list, each port chosen in proportion
+// to its weight.
+type Weighted struct {
+    hash crypto.Hash
+    ports []int
+    cum []uint32
+}
+
+// MaxWeight bounds a single weighted_ports weight.
+const MaxWeight = 1 << 16
+
+func NewWeighted(hash crypto.Hash, list []WeightedPort) (*Weighted, error) {
+    if len(list) == 0 { return nil, errors.New("weighted strategy requires weighted_ports") }
+    w := &Weighted{hash: hash}
+    var total uint32
+    for _, p := range list {
+        if p.Port <= 0 || p.Port > 65535 || p.Weight <= 0 || p.Weight > MaxWeight { return nil, errors.New("invalid weighted_ports entry") }
+        if total > math.MaxUint32-uint32(p.Weight) { return nil, errors.New("weighted_ports total weight too large") }
+        total += uint32(p.Weight)
+        w.ports = append(w.ports, p.Port)
+        w.cum = append(w.cum, total)
+    }
+    return w, nil
+}
+
+func (w *Weighted) Port(secret []byte, step int64) int {
+    v := totp(w.hash, secret, step) % w.cum[len(w.cum)-1]
+    for i, c := range w.cum {
+        if v < c { return w.ports[i] }
+    }
+    return w.ports[len(w.ports)-1]
+}
\ No newline at end of file
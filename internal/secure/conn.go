@@ -0,0 +1,80 @@
+package secure
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+)
+
+const maxFrame = 16 * 1024
+
+var ErrFrame = errors.New("secure: invalid frame")
+
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+    b, err := aes.NewCipher(key)
+    if err != nil { return nil, err }
+    return cipher.NewGCM(b)
+}
+
+// Conn frames a stream as [len uint16][AES-256-GCM sealed chunk], using an
+// independent key and a counter nonce per direction.
+type Conn struct {
+    net.Conn
+    send cipher.AEAD
+    recv cipher.AEAD
+    sendSeq uint64
+    recvSeq uint64
+    rbuf []byte
+    pending []byte
+    wbuf []byte
+}
+
+func NewConn(c net.Conn, sendKey, recvKey []byte) (*Conn, error) {
+    send, err := NewAEAD(sendKey)
+    if err != nil { return nil, err }
+    recv, err := NewAEAD(recvKey)
+    if err != nil { return nil, err }
+    return &Conn{Conn: c, send: send, recv: recv, rbuf: make([]byte, 2+maxFrame+recv.Overhead())}, nil
+}
+
+func seqNonce(a cipher.AEAD, seq uint64) []byte {
+    n := make([]byte, a.NonceSize())
+    binary.BigEndian.PutUint64(n[len(n)-8:], seq)
+    return n
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+    if len(c.pending) == 0 {
+        if _, err := io.ReadFull(c.Conn, c.rbuf[:2]); err != nil { return 0, err }
+        n := int(binary.BigEndian.Uint16(c.rbuf[:2]))
+        if n < c.recv.Overhead() || n > maxFrame+c.recv.Overhead() { return 0, ErrFrame }
+        sealed := c.rbuf[2 : 2+n]
+        if _, err := io.ReadFull(c.Conn, sealed); err != nil { return 0, err }
+        plain, err := c.recv.Open(sealed[:0], seqNonce(c.recv, c.recvSeq), sealed, nil)
+        if err != nil { return 0, ErrFrame }
+        c.recvSeq++
+        c.pending = plain
+    }
+    n := copy(p, c.pending)
+    c.pending = c.pending[n:]
+    return n, nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        chunk := p
+        if len(chunk) > maxFrame { chunk = chunk[:maxFrame] }
+        c.wbuf = append(c.wbuf[:0], 0, 0)
+        c.wbuf = c.send.Seal(c.wbuf, seqNonce(c.send, c.sendSeq), chunk, nil)
+        c.sendSeq++
+        binary.BigEndian.PutUint16(c.wbuf[:2], uint16(len(c.wbuf)-2))
+        if _, err := c.Conn.Write(c.wbuf); err != nil { return written, err }
+        written += len(chunk)
+        p = p[len(chunk):]
+    }
+    return written, nil
+}
\ No newline at end of file
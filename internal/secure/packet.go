@@ -0,0 +1,80 @@
+package secure
+
+import (
+    "bytes"
+    "crypto/cipher"
+    "encoding/binary"
+    "errors"
+)
+
+const SessionIDLen = 8
+
+const packetHeaderLen = SessionIDLen + 8
+
+var ErrPacket = errors.New("secure: unauthenticated packet")
+
+// Window is a 64-entry sliding anti-replay window over sequence numbers.
+type Window struct {
+    top uint64
+    bits uint64
+    used bool
+}
+
+func (w *Window) Accept(seq uint64) bool {
+    if !w.used || seq > w.top {
+        shift := seq - w.top
+        if !w.used || shift >= 64 { w.bits = 0 } else { w.bits <<= shift }
+        w.bits |= 1
+        w.top = seq
+        w.used = true
+        return true
+    }
+    d := w.top - seq
+    if d >= 64 || w.bits&(1<<d) != 0 { return false }
+    w.bits |= 1 << d
+    return true
+}
+
+// PacketCodec seals datagrams as [session id 8][seq 8][AEAD(payload)], with
+// the id and sequence number bound as additional data.
+type PacketCodec struct {
+    sid [SessionIDLen]byte
+    send cipher.AEAD
+    recv cipher.AEAD
+    sendSeq uint64
+    window Window
+}
+
+func NewPacketCodec(sid, sendKey, recvKey []byte) (*PacketCodec, error) {
+    if len(sid) < SessionIDLen { return nil, ErrPacket }
+    send, err := NewAEAD(sendKey)
+    if err != nil { return nil, err }
+    recv, err := NewAEAD(recvKey)
+    if err != nil { return nil, err }
+    p := &PacketCodec{send: send, recv: recv}
+    copy(p.sid[:], sid)
+    return p, nil
+}
+
+func PacketSessionID(pkt []byte) ([]byte, bool) {
+    if len(pkt) < packetHeaderLen { return nil, false }
+    return pkt[:SessionIDLen], true
+}
+
+func (p *PacketCodec) Seal(dst, plain []byte) []byte {
+    seq := p.sendSeq
+    p.sendSeq++
+    dst = append(dst, p.sid[:]...)
+    dst = binary.BigEndian.AppendUint64(dst, seq)
+    hdr := dst[len(dst)-packetHeaderLen:]
+    return p.send.Seal(dst, seqNonce(p.send, seq), plain, hdr)
+}
+
+func (p *PacketCodec) Open(pkt []byte) ([]byte, error) {
+    if len(pkt) < packetHeaderLen+p.recv.Overhead() || !bytes.Equal(pkt[:SessionIDLen], p.sid[:]) { return nil, ErrPacket }
+    seq := binary.BigEndian.Uint64(pkt[SessionIDLen:packetHeaderLen])
+    plain, err := p.recv.Open(nil, seqNonce(p.recv, seq), pkt[packetHeaderLen:], pkt[:packetHeaderLen])
+    if err != nil { return nil, ErrPacket }
+    if !p.window.Accept(seq) { return nil, ErrPacket }
+    return plain, nil
+}
\ No newline at end of file
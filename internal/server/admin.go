@@ -0,0 +1,49 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+)
+
+func routeKey(i int, s *Server) string {
+    if s.name != "" { return s.name }
+    return strconv.Itoa(i)
+}
+
+// AdminHandler serves counters (GET /stats), ban inspection (GET /bans) and
+// manual unban (POST /unban?route=&ip=) for a set of routes; bind it to
+// loopback only.
+func AdminHandler(servers []*Server) http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+        res := map[string]Stats{}
+        for i, s := range servers { res[routeKey(i, s)] = s.Stats() }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(res)
+    })
+    mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+        res := map[string][]Ban{}
+        for i, s := range servers { res[routeKey(i, s)] = s.Bans() }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(res)
+    })
+    mux.HandleFunc("/unban", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        route, ip := r.FormValue("route"), r.FormValue("ip")
+        removed := false
+        for i, s := range servers {
+            if route != "" && routeKey(i, s) != route { continue }
+            if s.Unban(ip) { removed = true }
+        }
+        if !removed {
+            http.Error(w, "not banned", http.StatusNotFound)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    })
+    return mux
+}
\ No newline at end of file
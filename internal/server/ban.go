@@ -0,0 +1,133 @@
+package server
+
+import (
+    "log"
+    "net"
+    "net/netip"
+    "sort"
+    "sync"
+    "time"
+    "okaroute/internal/config"
+)
+
+type Ban struct {
+    IP netip.Addr `json:"ip"`
+    Until time.Time `json:"until"`
+    Failures int `json:"failures"`
+}
+
+type banTracker struct {
+    mu sync.Mutex
+    cfg config.BanConfig
+    failures map[netip.Addr][]time.Time
+    bans map[netip.Addr]Ban
+}
+
+func newBanTracker(cfg config.BanConfig) *banTracker {
+    return &banTracker{cfg: cfg, failures: map[netip.Addr][]time.Time{}, bans: map[netip.Addr]Ban{}}
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+    ap, err := netip.ParseAddrPort(addr.String())
+    if err != nil { return netip.Addr{}, false }
+    return ap.Addr().Unmap(), true
+}
+
+func (b *banTracker) allowlisted(ip netip.Addr) bool {
+    for _, p := range b.cfg.AllowPrefixes {
+        if p.Contains(ip) { return true }
+    }
+    return false
+}
+
+func (b *banTracker) banned(ip netip.Addr) bool {
+    if b.cfg.MaxFailures == 0 { return false }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    ban, ok := b.bans[ip]
+    if !ok { return false }
+    if time.Now().After(ban.Until) {
+        delete(b.bans, ip)
+        return false
+    }
+    return true
+}
+
+// fail records a failed handshake and returns the new ban when the source
+// crossed max_failures within the window.
+func (b *banTracker) fail(ip netip.Addr) (Ban, bool) {
+    if b.cfg.MaxFailures == 0 || b.allowlisted(ip) { return Ban{}, false }
+    now := time.Now()
+    cutoff := now.Add(-time.Duration(b.cfg.WindowSeconds) * time.Second)
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    recent := b.failures[ip][:0]
+    for _, t := range b.failures[ip] {
+        if t.After(cutoff) { recent = append(recent, t) }
+    }
+    recent = append(recent, now)
+    if len(recent) < b.cfg.MaxFailures {
+        b.failures[ip] = recent
+        b.prune(cutoff)
+        return Ban{}, false
+    }
+    delete(b.failures, ip)
+    ban := Ban{IP: ip, Until: now.Add(time.Duration(b.cfg.BanSeconds) * time.Second), Failures: len(recent)}
+    b.bans[ip] = ban
+    return ban, true
+}
+
+func (b *banTracker) prune(cutoff time.Time) {
+    if len(b.failures) < 4096 { return }
+    for ip, ts := range b.failures {
+        if len(ts) == 0 || !ts[len(ts)-1].After(cutoff) { delete(b.failures, ip) }
+    }
+}
+
+func (b *banTracker) list() []Ban {
+    now := time.Now()
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    res := make([]Ban, 0, len(b.bans))
+    for ip, ban := range b.bans {
+        if now.After(ban.Until) { delete(b.bans, ip); continue }
+        res = append(res, ban)
+    }
+    sort.Slice(res, func(i, j int) bool { return res[i].IP.Less(res[j].IP) })
+    return res
+}
+
+func (b *banTracker) unban(ip netip.Addr) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    _, ok := b.bans[ip]
+    delete(b.bans, ip)
+    delete(b.failures, ip)
+    return ok
+}
+
+func (s *Server) Bans() []Ban { return s.bans.list() }
+
+func (s *Server) Unban(ip string) bool {
+    a, err := netip.ParseAddr(ip)
+    if err != nil { return false }
+    ok := s.bans.unban(a.Unmap())
+    if ok {
+        if s.name != "" { log.Printf("[%s] 服务端解除封禁: %s", s.name, a.Unmap()) } else { log.Printf("服务端解除封禁: %s", a.Unmap()) }
+    }
+    return ok
+}
+
+func (s *Server) isBanned(addr net.Addr) bool {
+    ip, ok := addrIP(addr)
+    return ok && s.bans.banned(ip)
+}
+
+// recordFailure 只应由 TCP 握手失败调用：UDP 来源地址可被伪造，据此封禁会让攻击者封掉任意 IP。
+func (s *Server) recordFailure(addr net.Addr) {
+    ip, ok := addrIP(addr)
+    if !ok { return }
+    if ban, ok := s.bans.fail(ip); ok {
+        if s.name != "" { log.Printf("[%s] 服务端封禁来源: %s 失败次数=%d 解封时间=%s", s.name, ip, ban.Failures, ban.Until.Format(time.RFC3339)) } else { log.Printf("服务端封禁来源: %s 失败次数=%d 解封时间=%s", ip, ban.Failures, ban.Until.Format(time.RFC3339)) }
+    }
+}
\ No newline at end of file
@@ -0,0 +1,150 @@
+package server
+
+import (
+    "log"
+    "net"
+    "net/netip"
+    "sync"
+    "time"
+    "okaroute/internal/auth"
+    "okaroute/internal/porthop"
+)
+
+type knockProgress struct {
+    step int64
+    next int
+}
+
+type knockState struct {
+    mu sync.Mutex
+    progress map[netip.Addr]knockProgress
+    allowed map[netip.Addr]time.Time
+}
+
+func newKnockState() *knockState {
+    return &knockState{progress: map[netip.Addr]knockProgress{}, allowed: map[netip.Addr]time.Time{}}
+}
+
+func (s *Server) knockSecrets() [][]byte {
+    var list [][]byte
+    for _, sec := range s.allHopSecrets() { list = append(list, porthop.LabelSecret(sec, "okaroute knock")) }
+    return list
+}
+
+func (k *knockState) isAllowed(ip netip.Addr) bool {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    until, ok := k.allowed[ip]
+    return ok && time.Now().Before(until)
+}
+
+func (k *knockState) anyAllowed() bool {
+    now := time.Now()
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    for ip, until := range k.allowed {
+        if now.Before(until) { return true }
+        delete(k.allowed, ip)
+    }
+    return false
+}
+
+// advance records a knock for step from ip on a port holding the given
+// sequence indices and reports whether the sequence of count knocks is now
+// complete. The expected next index wins over restarting at 0.
+func (k *knockState) advance(ip netip.Addr, step int64, indices []int, count int, window time.Duration) bool {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    p, ok := k.progress[ip]
+    i := -1
+    for _, j := range indices {
+        if ok && p.step == step && j == p.next { i = j; break }
+        if j == 0 { i = 0 }
+    }
+    if i < 0 {
+        delete(k.progress, ip)
+        return false
+    }
+    if i == 0 { p = knockProgress{step: step} }
+    p.next = i + 1
+    if p.next < count {
+        k.progress[ip] = p
+        return false
+    }
+    delete(k.progress, ip)
+    k.allowed[ip] = time.Now().Add(window)
+    return true
+}
+
+// knockPortSet returns the knock endpoints for the configured window around
+// step. Each step's knocks go to the listen address that step hops to.
+func (s *Server) knockPortSet(step int64) map[endpoint]struct{} {
+    set := map[endpoint]struct{}{}
+    hops := s.allHopSecrets()
+    for _, st := range porthop.WindowOrder(step, s.cfg.WindowBeforeSteps, s.cfg.WindowAfterSteps) {
+        for _, hop := range hops {
+            ip := s.cfg.ListenIPs[porthop.AddressIndex(s.cfg.Suite.Hop, hop, st, len(s.cfg.ListenIPs))]
+            sec := porthop.LabelSecret(hop, "okaroute knock")
+            for _, p := range porthop.KnockPorts(s.cfg.Suite.Hop, sec, st, s.cfg.Knock.Count, s.cfg.PortSet) {
+                set[endpoint{ip: ip, port: p}] = struct{}{}
+            }
+        }
+    }
+    return set
+}
+
+func (s *Server) syncKnockPortsLocked(step int64) {
+    set := s.knockPortSet(step)
+    for ep := range set {
+        if _, ok := s.knockConns[ep]; ok { continue }
+        addr, err := net.ResolveUDPAddr("udp", ep.String())
+        if err != nil { continue }
+        conn, err := net.ListenUDP("udp", addr)
+        if err != nil { continue }
+        s.knockConns[ep] = conn
+        go s.knockLoop(ep.port, conn)
+    }
+    for ep, conn := range s.knockConns {
+        if _, ok := set[ep]; !ok { conn.Close(); delete(s.knockConns, ep) }
+    }
+}
+
+func (s *Server) knockLoop(port int, conn *net.UDPConn) {
+    buf := make([]byte, 1024)
+    for {
+        n, addr, err := conn.ReadFromUDP(buf)
+        if err != nil { return }
+        if !s.sourceAllowed(addr) || s.isBanned(addr) { continue }
+        h, _, err := auth.ParseHeader(buf[:n])
+        if err != nil { continue }
+        nowStep := porthop.StepIndex(time.Now(), s.cfg.StepDuration)
+        if !porthop.ClampSkew(h.Step, nowStep, s.cfg.SkewSteps) || !s.verifyKnock(h) || s.replay.Seen(h.ClientID, h.Step, h.Nonce) { continue }
+        ip, ok := addrIP(addr)
+        if !ok { continue }
+        indices := s.knockIndices(port, h.Step)
+        if !s.knock.advance(ip, h.Step, indices, s.cfg.Knock.Count, time.Duration(s.cfg.Knock.WindowSeconds)*time.Second) { continue }
+        if s.name != "" { log.Printf("[%s] 服务端敲门成功: 来自=%s client=%s 放行%d秒", s.name, ip, h.ClientID, s.cfg.Knock.WindowSeconds) } else { log.Printf("服务端敲门成功: 来自=%s client=%s 放行%d秒", ip, h.ClientID, s.cfg.Knock.WindowSeconds) }
+        s.mu.Lock()
+        s.syncPortsLocked()
+        s.mu.Unlock()
+    }
+}
+
+// verifyKnock authenticates a knock header. Knocks are always version 1 and
+// carry no payload, so require_forward_secrecy does not apply to them.
+func (s *Server) verifyKnock(h *auth.Header) bool {
+    return h.Suite == s.cfg.Suite && s.clientAllowed(h.ClientID) && s.secretFor(h) != nil
+}
+
+// knockIndices returns every position port takes in the knock sequences of
+// step. A port is distinct within one secret's sequence but may appear in
+// the sequences of several hop secrets at different positions.
+func (s *Server) knockIndices(port int, step int64) []int {
+    var out []int
+    for _, sec := range s.knockSecrets() {
+        for i, p := range porthop.KnockPorts(s.cfg.Suite.Hop, sec, step, s.cfg.Knock.Count, s.cfg.PortSet) {
+            if p == port { out = append(out, i) }
+        }
+    }
+    return out
+}
\ No newline at end of file
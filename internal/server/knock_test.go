@@ -0,0 +1,26 @@
+package server
+
+import (
+    "net/netip"
+    "testing"
+    "time"
+    "okaroute/internal/auth"
+    "okaroute/internal/config"
+    "okaroute/internal/porthop"
+)
+
+func TestKnockSequenceAlwaysCompletes(t *testing.T) {
+    var ports []int
+    for p := 31000; p <= 31050; p++ { ports = append(ports, p) }
+    cfg := config.ServerConfig{PortSet: porthop.NewPortSet(ports), Suite: auth.DefaultSuite, Knock: config.KnockConfig{Enabled: true, Count: 3, WindowSeconds: 30}}
+    s := &Server{cfg: cfg, knock: newKnockState(), versions: []secretVersion{{key: []byte("first secret")}, {key: []byte("second secret")}}}
+    ip := netip.MustParseAddr("192.0.2.1")
+    for step := int64(0); step < 10000; step++ {
+        for _, sec := range s.knockSecrets() {
+            seq := porthop.KnockPorts(cfg.Suite.Hop, sec, step, cfg.Knock.Count, cfg.PortSet)
+            done := false
+            for _, p := range seq { done = s.knock.advance(ip, step, s.knockIndices(p, step), cfg.Knock.Count, time.Minute) }
+            if !done { t.Fatalf("step %d: knock sequence %v did not complete", step, seq) }
+        }
+    }
+}
\ No newline at end of file
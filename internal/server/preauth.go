@@ -0,0 +1,66 @@
+package server
+
+import (
+    "net/netip"
+    "sync"
+)
+
+type preauthLimiter struct {
+    mu sync.Mutex
+    maxTotal int
+    maxPerIP int
+    total int
+    perIP map[netip.Addr]int
+}
+
+func newPreauthLimiter(maxTotal, maxPerIP int) *preauthLimiter {
+    return &preauthLimiter{maxTotal: maxTotal, maxPerIP: maxPerIP, perIP: map[netip.Addr]int{}}
+}
+
+func (p *preauthLimiter) acquire(ip netip.Addr) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.total >= p.maxTotal || p.perIP[ip] >= p.maxPerIP { return false }
+    p.total++
+    p.perIP[ip]++
+    return true
+}
+
+func (p *preauthLimiter) release(ip netip.Addr) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.total--
+    if p.perIP[ip] <= 1 { delete(p.perIP, ip) } else { p.perIP[ip]-- }
+}
+
+func (p *preauthLimiter) pending() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.total
+}
+
+type Stats struct {
+    AuthFailures uint64 `json:"auth_failures"`
+    Replays uint64 `json:"replays"`
+    Rejected uint64 `json:"rejected"`
+    Blocked uint64 `json:"blocked"`
+    Dropped uint64 `json:"dropped_packets"`
+    PreauthTimeouts uint64 `json:"preauth_timeouts"`
+    PreauthOverflow uint64 `json:"preauth_overflow"`
+    PreauthPending int `json:"preauth_pending"`
+    BindFailures uint64 `json:"bind_failures"`
+}
+
+func (s *Server) Stats() Stats {
+    return Stats{
+        AuthFailures: s.authFailures.Load(),
+        Replays: s.replays.Load(),
+        Rejected: s.rejected.Load(),
+        Blocked: s.blocked.Load(),
+        Dropped: s.dropped.Load(),
+        PreauthTimeouts: s.preauthTimeouts.Load(),
+        PreauthOverflow: s.preauthOverflow.Load(),
+        PreauthPending: s.preauth.pending(),
+        BindFailures: s.bindFailures.Load(),
+    }
+}
\ No newline at end of file
@@ -0,0 +1,37 @@
+package server
+
+import (
+    "crypto/tls"
+    "io"
+    "net"
+    "time"
+    "okaroute/internal/forward"
+)
+
+// rejectProbe ends a connection that failed the handshake: it is spliced to
+// fallback_addr with the bytes already read replayed, or handled according
+// to probe_response, so failed handshakes look the same as any other probe.
+func (s *Server) rejectProbe(c net.Conn, read []byte) {
+    if s.cfg.FallbackAddr != "" {
+        c.SetDeadline(time.Time{})
+        go forward.Splice(c, s.cfg.FallbackAddr, read)
+        return
+    }
+    switch s.cfg.ProbeResponse {
+    case "hold":
+        c.SetDeadline(time.Now().Add(time.Duration(s.cfg.ProbeHoldSeconds) * time.Second))
+        io.Copy(io.Discard, c)
+    case "reset":
+        raw := c
+        if tc, ok := c.(*tls.Conn); ok { raw = tc.NetConn() }
+        if tcp, ok := raw.(*net.TCPConn); ok {
+            tcp.SetLinger(0)
+            tcp.Close()
+            return
+        }
+    case "decoy":
+        c.SetDeadline(time.Now().Add(5 * time.Second))
+        io.WriteString(c, s.cfg.DecoyBanner)
+    }
+    c.Close()
+}
\ No newline at end of file
@@ -1,18 +1,27 @@
 package server
 
 import (
+    "bytes"
     "context"
-    "encoding/binary"
+    "crypto/ecdh"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
     "io"
     "log"
     "net"
+    "net/netip"
+    "os"
     "strconv"
     "sync"
+    "sync/atomic"
     "time"
     "okaroute/internal/auth"
     "okaroute/internal/config"
     "okaroute/internal/forward"
     "okaroute/internal/porthop"
+    "okaroute/internal/secure"
 )
 
 type Server struct {
@@ -20,39 +29,107 @@ type Server struct {
     secret []byte
     target string
     mu sync.Mutex
-    listeners map[int]net.Listener
-    udpConns map[int]*net.UDPConn
-    udpSessions map[int]map[string]*udpSession
+    listeners map[endpoint]net.Listener
+    udpConns map[endpoint]*net.UDPConn
+    udpSessions map[endpoint]map[string]*udpSession
     currentStep int64
     name string
+    tlsConf *tls.Config
+    allowedIDs map[string]struct{}
+    clientSecrets map[string][]byte
+    hopSecrets [][]byte
+    versions []secretVersion
+    replay *auth.ReplayCache
+    replays atomic.Uint64
+    rejected atomic.Uint64
+    dropped atomic.Uint64
+    bans *banTracker
+    blocked atomic.Uint64
+    authFailures atomic.Uint64
+    preauth *preauthLimiter
+    preauthTimeouts atomic.Uint64
+    preauthOverflow atomic.Uint64
+    knock *knockState
+    busy map[endpoint]struct{}
+    timeConn *net.UDPConn
+    bindFailures atomic.Uint64
+    knockConns map[endpoint]*net.UDPConn
 }
 
-func New(cfg config.ServerConfig, secret []byte) *Server {
-    return &Server{cfg: cfg, secret: secret, target: net.JoinHostPort(cfg.TargetAddr, itoa(cfg.TargetPort)), listeners: map[int]net.Listener{}, udpConns: map[int]*net.UDPConn{}, udpSessions: map[int]map[string]*udpSession{}, name: cfg.Name}
+func New(cfg config.ServerConfig, secret []byte) (*Server, error) {
+    s := &Server{cfg: cfg, secret: secret, target: net.JoinHostPort(cfg.TargetAddr, itoa(cfg.TargetPort)), listeners: map[endpoint]net.Listener{}, udpConns: map[endpoint]*net.UDPConn{}, udpSessions: map[endpoint]map[string]*udpSession{}, name: cfg.Name, allowedIDs: map[string]struct{}{}, clientSecrets: map[string][]byte{}}
+    if len(secret) > 0 || len(cfg.Secrets) == 0 { s.versions = append(s.versions, secretVersion{key: secret}) }
+    for i, v := range cfg.Secrets {
+        sec, err := porthop.DecodeSecret(v.Secret)
+        if err != nil { return nil, errors.New("secrets[" + itoa(i) + "]: invalid secret") }
+        s.versions = append(s.versions, secretVersion{key: sec, activate: v.ActivateAt, expire: v.ExpireAt})
+    }
+    for _, id := range cfg.AllowedClientIDs { s.allowedIDs[id] = struct{}{} }
+    s.bans = newBanTracker(cfg.Ban)
+    s.preauth = newPreauthLimiter(cfg.MaxPreauthConns, cfg.MaxPreauthPerIP)
+    s.replay = auth.NewReplayCache(time.Duration(2*cfg.SkewSteps+2)*cfg.StepDuration, cfg.ReplayCacheSize)
+    for _, e := range cfg.Clients {
+        sec, err := porthop.DecodeSecret(e.Secret)
+        if err != nil { return nil, errors.New("clients[" + e.ID + "]: invalid secret") }
+        s.clientSecrets[e.ID] = sec
+        if e.HopSecret == "" { continue }
+        hop, err := porthop.DecodeSecret(e.HopSecret)
+        if err != nil { return nil, errors.New("clients[" + e.ID + "]: invalid hop_secret") }
+        if !containsSecret(s.hopSecrets, hop) { s.hopSecrets = append(s.hopSecrets, hop) }
+    }
+    if cfg.Knock.Enabled {
+        s.knock = newKnockState()
+        s.knockConns = map[endpoint]*net.UDPConn{}
+    }
+    if cfg.TLS.Enabled {
+        cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+        if err != nil { return nil, err }
+        s.tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+        if cfg.TLS.ClientCAFile != "" {
+            pem, err := os.ReadFile(cfg.TLS.ClientCAFile)
+            if err != nil { return nil, err }
+            pool := x509.NewCertPool()
+            if !pool.AppendCertsFromPEM(pem) { return nil, errors.New("tls client_ca_file contains no certificates") }
+            s.tlsConf.ClientCAs = pool
+            s.tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+        }
+    }
+    return s, nil
 }
 
 func itoa(i int) string { return fmtInt(i) }
 
 func fmtInt(i int) string { return strconv.FormatInt(int64(i), 10) }
 
-func (s *Server) openPort(port int) error {
-    if _, ok := s.listeners[port]; ok {
+// endpoint is a hop listener: one of the route's listen addresses and a port.
+type endpoint struct {
+    ip string
+    port int
+}
+
+func (e endpoint) String() string { return net.JoinHostPort(e.ip, fmtInt(e.port)) }
+
+func (s *Server) openPort(ep endpoint) error {
+    if _, ok := s.listeners[ep]; ok {
         return nil
     }
-    l, err := net.Listen("tcp", net.JoinHostPort(s.cfg.ListenIP, fmtInt(port)))
+    l, err := net.Listen("tcp", ep.String())
     if err != nil {
         return err
     }
-    s.listeners[port] = l
-    if s.name != "" { log.Printf("[%s] 服务端开始监听端口: %d", s.name, port) } else { log.Printf("服务端开始监听端口: %d", port) }
-    go s.acceptLoop(port, l)
+    if s.tlsConf != nil {
+        l = tls.NewListener(l, s.tlsConf)
+    }
+    s.listeners[ep] = l
+    if s.name != "" { log.Printf("[%s] 服务端开始监听端口: %d 地址=%s", s.name, ep.port, ep.ip) } else { log.Printf("服务端开始监听端口: %d 地址=%s", ep.port, ep.ip) }
+    go s.acceptLoop(ep.port, l)
     return nil
 }
 
-func (s *Server) closePort(port int) {
-    if l, ok := s.listeners[port]; ok {
+func (s *Server) closePort(ep endpoint) {
+    if l, ok := s.listeners[ep]; ok {
         l.Close()
-        delete(s.listeners, port)
+        delete(s.listeners, ep)
     }
 }
 
@@ -62,132 +139,504 @@ func (s *Server) acceptLoop(port int, l net.Listener) {
         if err != nil {
             return
         }
-        go s.handleConnOnPort(port, c)
+        if !s.sourceAllowed(c.RemoteAddr()) {
+            n := s.rejected.Add(1)
+            if s.name != "" { log.Printf("[%s] 服务端拒绝连接: 来源不在白名单, 来自=%s 使用端口=%d 累计拒绝=%d", s.name, c.RemoteAddr().String(), port, n) } else { log.Printf("服务端拒绝连接: 来源不在白名单, 来自=%s 使用端口=%d 累计拒绝=%d", c.RemoteAddr().String(), port, n) }
+            c.Close()
+            continue
+        }
+        if s.isBanned(c.RemoteAddr()) {
+            s.blocked.Add(1)
+            c.Close()
+            continue
+        }
+        ip, _ := addrIP(c.RemoteAddr())
+        if s.knock != nil && !s.knock.isAllowed(ip) {
+            s.rejected.Add(1)
+            c.Close()
+            continue
+        }
+        if !s.preauth.acquire(ip) {
+            n := s.preauthOverflow.Add(1)
+            if s.name != "" { log.Printf("[%s] 服务端丢弃连接: 未鉴权连接数超限, 来自=%s 使用端口=%d 累计丢弃=%d", s.name, c.RemoteAddr().String(), port, n) } else { log.Printf("服务端丢弃连接: 未鉴权连接数超限, 来自=%s 使用端口=%d 累计丢弃=%d", c.RemoteAddr().String(), port, n) }
+            c.Close()
+            continue
+        }
+        go s.handleConnOnPort(port, c, ip)
     }
 }
 
-func (s *Server) handleConnOnPort(port int, c net.Conn) {
-    var hdr [8 + 16 + 32]byte
-    if _, err := ioReadFull(c, hdr[:]); err != nil {
-        c.Close()
+func (s *Server) handleConnOnPort(port int, c net.Conn, ip netip.Addr) {
+    released := false
+    release := func() {
+        if !released { released = true; s.preauth.release(ip) }
+    }
+    defer release()
+    c.SetDeadline(time.Now().Add(time.Duration(s.cfg.HandshakeTimeoutSeconds) * time.Second))
+    var read bytes.Buffer
+    h, err := auth.ReadHeader(io.TeeReader(c, &read))
+    if err != nil {
+        if ne, ok := err.(net.Error); ok && ne.Timeout() {
+            n := s.preauthTimeouts.Add(1)
+            if s.name != "" { log.Printf("[%s] 服务端握手超时: 来自=%s 使用端口=%d 累计超时=%d", s.name, c.RemoteAddr().String(), port, n) } else { log.Printf("服务端握手超时: 来自=%s 使用端口=%d 累计超时=%d", c.RemoteAddr().String(), port, n) }
+        }
+        if errors.Is(err, auth.ErrSuite) {
+            if s.name != "" { log.Printf("[%s] 服务端握手失败: 不支持的算法组合, 来自=%s 使用端口=%d", s.name, c.RemoteAddr().String(), port) } else { log.Printf("服务端握手失败: 不支持的算法组合, 来自=%s 使用端口=%d", c.RemoteAddr().String(), port) }
+        }
+        if errors.Is(err, auth.ErrVersion) || errors.Is(err, auth.ErrSuite) { s.recordFailure(c.RemoteAddr()) }
+        s.rejectProbe(c, read.Bytes())
+        return
+    }
+    if h.Suite != s.cfg.Suite {
+        if s.name != "" { log.Printf("[%s] 服务端握手失败: 算法不匹配, 来自=%s 使用端口=%d client=%q 对端=%s 本端=%s", s.name, c.RemoteAddr().String(), port, h.ClientID, h.Suite, s.cfg.Suite) } else { log.Printf("服务端握手失败: 算法不匹配, 来自=%s 使用端口=%d client=%q 对端=%s 本端=%s", c.RemoteAddr().String(), port, h.ClientID, h.Suite, s.cfg.Suite) }
+        s.authFailures.Add(1)
+        s.recordFailure(c.RemoteAddr())
+        s.rejectProbe(c, read.Bytes())
+        return
+    }
+    if h.Version == auth.Version1 && headerEncryption(h) != s.cfg.Encryption {
+        if s.name != "" { log.Printf("[%s] 服务端握手失败: 加密方式不匹配, 来自=%s 使用端口=%d client=%q 对端=%s 本端=%s", s.name, c.RemoteAddr().String(), port, h.ClientID, headerEncryption(h), s.cfg.Encryption) } else { log.Printf("服务端握手失败: 加密方式不匹配, 来自=%s 使用端口=%d client=%q 对端=%s 本端=%s", c.RemoteAddr().String(), port, h.ClientID, headerEncryption(h), s.cfg.Encryption) }
+        s.authFailures.Add(1)
+        s.recordFailure(c.RemoteAddr())
+        s.rejectProbe(c, read.Bytes())
+        return
+    }
+    nowStep := porthop.StepIndex(time.Now(), s.cfg.StepDuration)
+    if !porthop.ClampSkew(h.Step, nowStep, s.cfg.SkewSteps) {
+        if s.name != "" { log.Printf("[%s] 服务端握手失败: 步长超出容忍, 来自=%s 使用端口=%d 声明step=%d 当前step=%d", s.name, c.RemoteAddr().String(), port, h.Step, nowStep) } else { log.Printf("服务端握手失败: 步长超出容忍, 来自=%s 使用端口=%d 声明step=%d 当前step=%d", c.RemoteAddr().String(), port, h.Step, nowStep) }
+        s.authFailures.Add(1)
+        s.recordFailure(c.RemoteAddr())
+        s.rejectProbe(c, read.Bytes())
+        return
+    }
+    if !s.clientAllowed(h.ClientID) {
+        if s.name != "" { log.Printf("[%s] 服务端握手失败: 未授权的client_id, 来自=%s 使用端口=%d client=%q", s.name, c.RemoteAddr().String(), port, h.ClientID) } else { log.Printf("服务端握手失败: 未授权的client_id, 来自=%s 使用端口=%d client=%q", c.RemoteAddr().String(), port, h.ClientID) }
+        s.authFailures.Add(1)
+        s.recordFailure(c.RemoteAddr())
+        s.rejectProbe(c, read.Bytes())
         return
     }
-    step := int64(binary.BigEndian.Uint64(hdr[0:8]))
-    nonce := hdr[8:24]
-    token := hdr[24:56]
-    nowStep := porthop.StepIndex(time.Now(), s.cfg.StepSeconds)
-    if !porthop.ClampSkew(step, nowStep, s.cfg.SkewSteps) {
-        if s.name != "" { log.Printf("[%s] 服务端握手失败: 步长超出容忍, 来自=%s 使用端口=%d 声明step=%d 当前step=%d", s.name, c.RemoteAddr().String(), port, step, nowStep) } else { log.Printf("服务端握手失败: 步长超出容忍, 来自=%s 使用端口=%d 声明step=%d 当前step=%d", c.RemoteAddr().String(), port, step, nowStep) }
-        c.Close()
+    if ids := peerIdentities(c); ids != nil && !containsID(ids, h.ClientID) {
+        if s.name != "" { log.Printf("[%s] 服务端握手失败: 证书身份与鉴权身份不一致, 来自=%s 使用端口=%d client=%q 证书身份=%v", s.name, c.RemoteAddr().String(), port, h.ClientID, ids) } else { log.Printf("服务端握手失败: 证书身份与鉴权身份不一致, 来自=%s 使用端口=%d client=%q 证书身份=%v", c.RemoteAddr().String(), port, h.ClientID, ids) }
+        s.authFailures.Add(1)
+        s.recordFailure(c.RemoteAddr())
+        s.rejectProbe(c, read.Bytes())
         return
     }
-    if !auth.Verify(s.secret, step, nonce, token, "client") {
-        if s.name != "" { log.Printf("[%s] 服务端握手失败: 鉴权无效, 来自=%s 使用端口=%d step=%d", s.name, c.RemoteAddr().String(), port, step) } else { log.Printf("服务端握手失败: 鉴权无效, 来自=%s 使用端口=%d step=%d", c.RemoteAddr().String(), port, step) }
-        c.Close()
+    if s.secretFor(h) == nil {
+        if s.name != "" { log.Printf("[%s] 服务端握手失败: 鉴权无效, 来自=%s 使用端口=%d step=%d client=%q", s.name, c.RemoteAddr().String(), port, h.Step, h.ClientID) } else { log.Printf("服务端握手失败: 鉴权无效, 来自=%s 使用端口=%d step=%d client=%q", c.RemoteAddr().String(), port, h.Step, h.ClientID) }
+        s.authFailures.Add(1)
+        s.recordFailure(c.RemoteAddr())
+        s.rejectProbe(c, read.Bytes())
         return
     }
-    if s.name != "" { log.Printf("[%s] 服务端接受连接: 来自=%s 转发端口=%d step=%d 目标=%s", s.name, c.RemoteAddr().String(), port, step, s.target) } else { log.Printf("服务端接受连接: 来自=%s 转发端口=%d step=%d 目标=%s", c.RemoteAddr().String(), port, step, s.target) }
+    if h.Version != auth.Version2 && s.cfg.RequireForwardSecrecy {
+        if s.name != "" { log.Printf("[%s] 服务端握手失败: 要求前向保密握手, 来自=%s 使用端口=%d client=%q 版本=%d", s.name, c.RemoteAddr().String(), port, h.ClientID, h.Version) } else { log.Printf("服务端握手失败: 要求前向保密握手, 来自=%s 使用端口=%d client=%q 版本=%d", c.RemoteAddr().String(), port, h.ClientID, h.Version) }
+        s.rejectProbe(c, read.Bytes())
+        return
+    }
+    if s.replay.Seen(h.ClientID, h.Step, h.Nonce) {
+        n := s.replays.Add(1)
+        if s.name != "" { log.Printf("[%s] 服务端握手失败: 重放的握手, 来自=%s 使用端口=%d step=%d client=%q 累计重放=%d", s.name, c.RemoteAddr().String(), port, h.Step, h.ClientID, n) } else { log.Printf("服务端握手失败: 重放的握手, 来自=%s 使用端口=%d step=%d client=%q 累计重放=%d", c.RemoteAddr().String(), port, h.Step, h.ClientID, n) }
+        s.rejectProbe(c, read.Bytes())
+        return
+    }
+    mode := s.cfg.Encryption
+    var c2s, s2c []byte
+    if h.Version == auth.Version2 {
+        var reply []byte
+        c2s, s2c, reply, err = s.keyExchange(h)
+        if err == nil { _, err = c.Write(reply) }
+        if err != nil {
+            c.Close()
+            return
+        }
+        mode = "x25519+aes-256-gcm"
+    } else {
+        if h.Flags&auth.VersionAck != 0 {
+            if _, err := c.Write(auth.AckMAC(s.secretFor(h), h)); err != nil {
+                c.Close()
+                return
+            }
+        }
+        if s.cfg.Encryption != "none" { c2s, s2c = auth.SessionKeys(s.secretFor(h), h.Step, h.Nonce, h.ClientID) }
+    }
+    c.SetDeadline(time.Time{})
+    release()
+    if c2s != nil {
+        sc, err := secure.NewConn(c, s2c, c2s)
+        if err != nil {
+            c.Close()
+            return
+        }
+        c = sc
+    }
+    if s.name != "" { log.Printf("[%s] 服务端接受连接: 来自=%s client=%s 转发端口=%d step=%d 加密=%s 目标=%s", s.name, c.RemoteAddr().String(), h.ClientID, port, h.Step, mode, s.target) } else { log.Printf("服务端接受连接: 来自=%s client=%s 转发端口=%d step=%d 加密=%s 目标=%s", c.RemoteAddr().String(), h.ClientID, port, h.Step, mode, s.target) }
     forward.HandleTCP(c, s.target)
 }
 
-func ioReadFull(c net.Conn, b []byte) (int, error) { return io.ReadFull(c, b) }
+// headerEncryption is the payload encryption a version 1 header announces.
+func headerEncryption(h *auth.Header) string {
+    if h.Flags&auth.VersionSealed != 0 { return "aes-256-gcm" }
+    return "none"
+}
+
+func (s *Server) keyExchange(h *auth.Header) ([]byte, []byte, []byte, error) {
+    priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil { return nil, nil, nil, err }
+    peer, err := ecdh.X25519().NewPublicKey(h.PubKey)
+    if err != nil { return nil, nil, nil, err }
+    shared, err := priv.ECDH(peer)
+    if err != nil { return nil, nil, nil, err }
+    pub := priv.PublicKey().Bytes()
+    c2s, s2c := auth.KeyExchangeKeys(shared, h, pub)
+    return c2s, s2c, append(pub, auth.ReplyMAC(s.secretFor(h), h, pub)...), nil
+}
+
+func (s *Server) Name() string { return s.name }
+
+func (s *Server) sourceAllowed(addr net.Addr) bool {
+    if len(s.cfg.AllowedPrefixes) == 0 { return true }
+    ip, ok := addrIP(addr)
+    if !ok { return false }
+    for _, p := range s.cfg.AllowedPrefixes {
+        if p.Contains(ip) { return true }
+    }
+    return false
+}
+
+func (s *Server) clientAllowed(id string) bool {
+    if len(s.clientSecrets) > 0 {
+        if _, ok := s.clientSecrets[id]; !ok { return false }
+    }
+    if len(s.allowedIDs) == 0 { return true }
+    _, ok := s.allowedIDs[id]
+    return ok
+}
+
+// secretFor returns the secret that authenticates h: the client's own secret
+// when it has one, otherwise whichever route secret version currently in
+// effect verifies the token. It returns nil when none does.
+func (s *Server) secretFor(h *auth.Header) []byte {
+    return s.matchSecret(h.ClientID, h.Verify)
+}
+
+func (s *Server) matchSecret(clientID string, verify func([]byte) bool) []byte {
+    if sec, ok := s.clientSecrets[clientID]; ok {
+        if verify(sec) { return sec }
+        return nil
+    }
+    for _, sec := range s.routeSecrets(time.Now()) {
+        if verify(sec) { return sec }
+    }
+    return nil
+}
+
+func (s *Server) verify(h *auth.Header) bool {
+    return h.Suite == s.cfg.Suite && s.clientAllowed(h.ClientID) && s.secretFor(h) != nil && (h.Version == auth.Version2 || !s.cfg.RequireForwardSecrecy)
+}
+
+// routeSecrets returns the route secret versions in effect at t. Activation
+// and expiry are widened by the skew window so clients whose clocks are
+// slightly off still switch over cleanly.
+func (s *Server) routeSecrets(t time.Time) [][]byte {
+    grace := time.Duration(s.cfg.SkewSteps+1) * s.cfg.StepDuration
+    var out [][]byte
+    for _, v := range s.versions {
+        if !v.activate.IsZero() && t.Before(v.activate.Add(-grace)) { continue }
+        if !v.expire.IsZero() && !t.Before(v.expire.Add(grace)) { continue }
+        out = append(out, v.key)
+    }
+    return out
+}
+
+// currentSecret is the most recently activated route secret in effect, used
+// for logging the port triplet.
+func (s *Server) currentSecret() []byte {
+    now := time.Now()
+    var best *secretVersion
+    for i := range s.versions {
+        v := &s.versions[i]
+        if !v.activate.IsZero() && now.Before(v.activate) { continue }
+        if !v.expire.IsZero() && !now.Before(v.expire) { continue }
+        if best == nil || v.activate.After(best.activate) { best = v }
+    }
+    if best == nil { return s.secret }
+    return best.key
+}
+
+func (s *Server) allHopSecrets() [][]byte {
+    list := s.routeSecrets(time.Now())
+    for _, sec := range s.hopSecrets {
+        if !containsSecret(list, sec) { list = append(list, sec) }
+    }
+    return list
+}
+
+func containsSecret(list [][]byte, sec []byte) bool {
+    for _, v := range list {
+        if bytes.Equal(v, sec) { return true }
+    }
+    return false
+}
+
+func containsID(ids []string, id string) bool {
+    for _, v := range ids {
+        if v == id { return true }
+    }
+    return false
+}
+
+func peerIdentities(c net.Conn) []string {
+    tc, ok := c.(*tls.Conn)
+    if !ok { return nil }
+    certs := tc.ConnectionState().PeerCertificates
+    if len(certs) == 0 { return nil }
+    cert := certs[0]
+    ids := []string{}
+    if cert.Subject.CommonName != "" { ids = append(ids, cert.Subject.CommonName) }
+    ids = append(ids, cert.DNSNames...)
+    for _, u := range cert.URIs { ids = append(ids, u.String()) }
+    return ids
+}
+
+type secretVersion struct {
+    key []byte
+    activate time.Time
+    expire time.Time
+}
+
 type udpSession struct {
     dst *net.UDPConn
     client *net.UDPAddr
+    clientID string
+    codec *secure.PacketCodec
     authenticated bool
 }
 
-func (s *Server) openUDP(port int) error {
-    if _, ok := s.udpConns[port]; ok { return nil }
-    addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s.cfg.ListenIP, fmtInt(port)))
+func (s *Server) openUDP(ep endpoint) error {
+    if _, ok := s.udpConns[ep]; ok { return nil }
+    addr, err := net.ResolveUDPAddr("udp", ep.String())
     if err != nil { return err }
     conn, err := net.ListenUDP("udp", addr)
     if err != nil { return err }
-    s.udpConns[port] = conn
-    s.udpSessions[port] = map[string]*udpSession{}
-    if s.name != "" { log.Printf("[%s] 服务端开始监听端口(UDP): %d", s.name, port) } else { log.Printf("服务端开始监听端口(UDP): %d", port) }
-    go s.udpLoop(port, conn)
+    s.udpConns[ep] = conn
+    s.udpSessions[ep] = map[string]*udpSession{}
+    if s.name != "" { log.Printf("[%s] 服务端开始监听端口(UDP): %d 地址=%s", s.name, ep.port, ep.ip) } else { log.Printf("服务端开始监听端口(UDP): %d 地址=%s", ep.port, ep.ip) }
+    go s.udpLoop(ep, conn)
     return nil
 }
 
-func (s *Server) closeUDP(port int) {
-    if c, ok := s.udpConns[port]; ok { c.Close(); delete(s.udpConns, port) }
-    delete(s.udpSessions, port)
+func (s *Server) closeUDP(ep endpoint) {
+    if c, ok := s.udpConns[ep]; ok { c.Close(); delete(s.udpConns, ep) }
+    delete(s.udpSessions, ep)
 }
 
-func (s *Server) udpLoop(port int, conn *net.UDPConn) {
+func (s *Server) udpLoop(ep endpoint, conn *net.UDPConn) {
+    port := ep.port
     buf := make([]byte, 65535)
     targetAddr, _ := net.ResolveUDPAddr("udp", s.target)
+    sealed := s.cfg.Encryption != "none"
     for {
         n, clientAddr, err := conn.ReadFromUDP(buf)
         if err != nil { return }
+        if !s.sourceAllowed(clientAddr) {
+            rn := s.rejected.Add(1)
+            if s.name != "" { log.Printf("[%s] 服务端拒绝报文(UDP): 来源不在白名单, 来自=%s 使用端口=%d 累计拒绝=%d", s.name, clientAddr.String(), port, rn) } else { log.Printf("服务端拒绝报文(UDP): 来源不在白名单, 来自=%s 使用端口=%d 累计拒绝=%d", clientAddr.String(), port, rn) }
+            continue
+        }
+        if s.isBanned(clientAddr) {
+            s.blocked.Add(1)
+            continue
+        }
         key := clientAddr.String()
         s.mu.Lock()
-        sess := s.udpSessions[port][key]
+        var sess *udpSession
+        if sid, ok := secure.PacketSessionID(buf[:n]); ok { sess = s.udpSessions[ep][string(sid)] }
+        if sess == nil { sess = s.udpSessions[ep][key] }
         if sess == nil {
-            if n < (8+16+32) { s.mu.Unlock(); continue }
-            step := int64(binary.BigEndian.Uint64(buf[0:8]))
-            nonce := buf[8:24]
-            token := buf[24:56]
-            nowStep := porthop.StepIndex(time.Now(), s.cfg.StepSeconds)
-            if !porthop.ClampSkew(step, nowStep, s.cfg.SkewSteps) || !auth.Verify(s.secret, step, nonce, token, "client") {
+            h, hn, err := auth.ParseHeader(buf[:n])
+            if err != nil {
+                s.mu.Unlock()
+                s.dropped.Add(1)
+                continue
+            }
+            if h.Suite != s.cfg.Suite {
+                s.mu.Unlock()
+                if s.name != "" { log.Printf("[%s] 服务端握手失败(UDP): 算法不匹配, 来自=%s 使用端口=%d client=%q 对端=%s 本端=%s", s.name, clientAddr.String(), port, h.ClientID, h.Suite, s.cfg.Suite) } else { log.Printf("服务端握手失败(UDP): 算法不匹配, 来自=%s 使用端口=%d client=%q 对端=%s 本端=%s", clientAddr.String(), port, h.ClientID, h.Suite, s.cfg.Suite) }
+                s.authFailures.Add(1)
+                continue
+            }
+            if h.Version == auth.Version1 && headerEncryption(h) != s.cfg.Encryption {
+                s.mu.Unlock()
+                if s.name != "" { log.Printf("[%s] 服务端握手失败(UDP): 加密方式不匹配, 来自=%s 使用端口=%d client=%q 对端=%s 本端=%s", s.name, clientAddr.String(), port, h.ClientID, headerEncryption(h), s.cfg.Encryption) } else { log.Printf("服务端握手失败(UDP): 加密方式不匹配, 来自=%s 使用端口=%d client=%q 对端=%s 本端=%s", clientAddr.String(), port, h.ClientID, headerEncryption(h), s.cfg.Encryption) }
+                s.authFailures.Add(1)
+                continue
+            }
+            nowStep := porthop.StepIndex(time.Now(), s.cfg.StepDuration)
+            if !porthop.ClampSkew(h.Step, nowStep, s.cfg.SkewSteps) || !s.verify(h) {
+                s.mu.Unlock()
+                s.authFailures.Add(1)
+                continue
+            }
+            if s.replay.Seen(h.ClientID, h.Step, h.Nonce) {
+                rn := s.replays.Add(1)
+                if s.name != "" { log.Printf("[%s] 服务端握手失败(UDP): 重放的握手, 来自=%s 使用端口=%d step=%d client=%q 累计重放=%d", s.name, clientAddr.String(), port, h.Step, h.ClientID, rn) } else { log.Printf("服务端握手失败(UDP): 重放的握手, 来自=%s 使用端口=%d step=%d client=%q 累计重放=%d", clientAddr.String(), port, h.Step, h.ClientID, rn) }
                 s.mu.Unlock(); continue
             }
+            payload := buf[hn:n]
+            mode := s.cfg.Encryption
+            var codec *secure.PacketCodec
+            if h.Version == auth.Version2 {
+                c2s, s2c, reply, err := s.keyExchange(h)
+                if err != nil { s.mu.Unlock(); continue }
+                if codec, err = secure.NewPacketCodec(h.Nonce[:secure.SessionIDLen], s2c, c2s); err != nil { s.mu.Unlock(); continue }
+                conn.WriteToUDP(reply, clientAddr)
+                payload = nil
+                key = string(h.Nonce[:secure.SessionIDLen])
+                mode = "x25519+aes-256-gcm"
+            } else if sealed {
+                c2s, s2c := auth.SessionKeys(s.secretFor(h), h.Step, h.Nonce, h.ClientID)
+                codec, err = secure.NewPacketCodec(h.Nonce[:secure.SessionIDLen], s2c, c2s)
+                if err != nil { s.mu.Unlock(); continue }
+                if payload, err = codec.Open(payload); err != nil {
+                    s.dropped.Add(1)
+                    s.mu.Unlock(); continue
+                }
+                key = string(h.Nonce[:secure.SessionIDLen])
+            }
             dst, err := net.DialUDP("udp", nil, targetAddr)
             if err != nil { s.mu.Unlock(); continue }
-            sess = &udpSession{dst: dst, client: clientAddr, authenticated: true}
-            s.udpSessions[port][key] = sess
+            sess = &udpSession{dst: dst, client: clientAddr, clientID: h.ClientID, codec: codec, authenticated: true}
+            if s.name != "" { log.Printf("[%s] 服务端建立UDP会话: 来自=%s client=%s 转发端口=%d step=%d 加密=%s 目标=%s", s.name, clientAddr.String(), h.ClientID, port, h.Step, mode, s.target) } else { log.Printf("服务端建立UDP会话: 来自=%s client=%s 转发端口=%d step=%d 加密=%s 目标=%s", clientAddr.String(), h.ClientID, port, h.Step, mode, s.target) }
+            s.udpSessions[ep][key] = sess
             go func(sess *udpSession) {
                 rbuf := make([]byte, 65535)
+                var out []byte
                 for {
                     rn, _, rerr := sess.dst.ReadFromUDP(rbuf)
                     if rerr != nil { return }
+                    if sess.codec != nil {
+                        out = sess.codec.Seal(out[:0], rbuf[:rn])
+                        conn.WriteToUDP(out, sess.client)
+                        continue
+                    }
                     conn.WriteToUDP(rbuf[:rn], sess.client)
                 }
             }(sess)
-            payload := buf[56:n]
-            sess.dst.Write(payload)
+            if h.Version != auth.Version2 && h.Flags&auth.VersionAck != 0 { conn.WriteToUDP(auth.AckMAC(s.secretFor(h), h), clientAddr) }
+            if len(payload) > 0 { sess.dst.Write(payload) }
             s.mu.Unlock()
             continue
         }
         s.mu.Unlock()
+        if sess.codec != nil {
+            plain, err := sess.codec.Open(buf[:n])
+            if err != nil { s.dropped.Add(1); continue }
+            sess.dst.Write(plain)
+            continue
+        }
         sess.dst.Write(buf[:n])
     }
 }
 
+// hopChains returns, for every hop secret and each step of the configured
+// window around step, the primary endpoint followed by its alternates.
+func (s *Server) hopChains(step int64) [][]endpoint {
+    if s.knock != nil && !s.knock.anyAllowed() { return nil }
+    var chains [][]endpoint
+    for _, sec := range s.allHopSecrets() {
+        for _, st := range porthop.WindowOrder(step, s.cfg.WindowBeforeSteps, s.cfg.WindowAfterSteps) {
+            var chain []endpoint
+            for _, e := range porthop.Endpoints(s.cfg.HopStrategy, s.cfg.Suite.Hop, sec, st, s.cfg.HopAlternates, len(s.cfg.ListenIPs)) {
+                chain = append(chain, endpoint{ip: s.cfg.ListenIPs[e.Addr], port: e.Port})
+            }
+            chains = append(chains, chain)
+        }
+    }
+    return chains
+}
+
+// stepIP returns the listen address the current hop secret uses at step.
+func (s *Server) stepIP(step int64) string {
+    return s.cfg.ListenIPs[porthop.AddressIndex(s.cfg.Suite.Hop, s.currentSecret(), step, len(s.cfg.ListenIPs))]
+}
+
+// syncPortsLocked opens the first bindable endpoint of every hop chain for
+// the current step and closes the rest. An endpoint that fails to bind is
+// reported once while it stays busy. It returns the last bind error when no
+// hop endpoint could be opened at all.
+func (s *Server) syncPortsLocked() error {
+    newSet := map[endpoint]struct{}{}
+    busy := map[endpoint]struct{}{}
+    var lastErr error
+    for _, chain := range s.hopChains(s.currentStep) {
+        for _, ep := range chain {
+            var err error
+            if s.cfg.Protocol == "udp" { err = s.openUDP(ep) } else { err = s.openPort(ep) }
+            if err == nil { newSet[ep] = struct{}{}; break }
+            lastErr = err
+            busy[ep] = struct{}{}
+            if _, ok := s.busy[ep]; !ok {
+                s.bindFailures.Add(1)
+                if s.name != "" { log.Printf("[%s] 服务端端口绑定失败, 改用备用端口: 端口=%d 地址=%s 错误=%v", s.name, ep.port, ep.ip, err) } else { log.Printf("服务端端口绑定失败, 改用备用端口: 端口=%d 地址=%s 错误=%v", ep.port, ep.ip, err) }
+            }
+        }
+    }
+    s.busy = busy
+    for ep := range s.listeners { if _, ok := newSet[ep]; !ok { s.closePort(ep); if s.name != "" { log.Printf("[%s] 服务端关闭端口: %d 地址=%s", s.name, ep.port, ep.ip) } else { log.Printf("服务端关闭端口: %d 地址=%s", ep.port, ep.ip) } } }
+    for ep := range s.udpConns { if _, ok := newSet[ep]; !ok { s.closeUDP(ep); if s.name != "" { log.Printf("[%s] 服务端关闭端口: %d 地址=%s", s.name, ep.port, ep.ip) } else { log.Printf("服务端关闭端口: %d 地址=%s", ep.port, ep.ip) } } }
+    if s.knock != nil { s.syncKnockPortsLocked(s.currentStep) }
+    if len(newSet) == 0 { return lastErr }
+    return nil
+}
+
 func (s *Server) Start(ctx context.Context) error {
-    s.currentStep = porthop.StepIndex(time.Now(), s.cfg.StepSeconds)
-    prev, curr, next := porthop.Triplet(s.secret, s.currentStep, s.cfg.PortRange.Min, s.cfg.PortRange.Max)
-    ports := porthop.UniquePorts([]int{prev, curr, next})
-    for _, p := range ports {
-        if s.cfg.Protocol == "udp" {
-            if err := s.openUDP(p); err != nil { return err }
-        } else {
-            if err := s.openPort(p); err != nil { return err }
-        }
-    }
-    if s.name != "" { log.Printf("[%s] 服务端启动: step=%d 监听端口 prev=%d curr=%d next=%d 目标=%s", s.name, s.currentStep, prev, curr, next, s.target) } else { log.Printf("服务端启动: step=%d 监听端口 prev=%d curr=%d next=%d 目标=%s", s.currentStep, prev, curr, next, s.target) }
-    t := time.NewTicker(time.Duration(s.cfg.StepSeconds) * time.Second)
-    defer t.Stop()
+    s.mu.Lock()
+    s.currentStep = porthop.StepIndex(time.Now(), s.cfg.StepDuration)
+    prev, curr, next := porthop.StrategyTriplet(s.cfg.HopStrategy, s.currentSecret(), s.currentStep)
+    if err := s.syncPortsLocked(); err != nil { s.mu.Unlock(); return err }
+    if s.cfg.TimeProbePort > 0 {
+        if err := s.openTimeProbe(); err != nil { s.mu.Unlock(); return err }
+    }
+    s.mu.Unlock()
+    ip := s.stepIP(s.currentStep)
+    if s.name != "" { log.Printf("[%s] 服务端启动: step=%d 监听端口 prev=%d curr=%d next=%d 当前地址=%s 目标=%s", s.name, s.currentStep, prev, curr, next, ip, s.target) } else { log.Printf("服务端启动: step=%d 监听端口 prev=%d curr=%d next=%d 当前地址=%s 目标=%s", s.currentStep, prev, curr, next, ip, s.target) }
     for {
+        t := time.NewTimer(s.rotationWait())
         select {
         case <-ctx.Done():
+            t.Stop()
             s.mu.Lock()
             for p, l := range s.listeners { l.Close(); delete(s.listeners, p) }
             for p, u := range s.udpConns { u.Close(); delete(s.udpConns, p) }
+            for p, u := range s.knockConns { u.Close(); delete(s.knockConns, p) }
+            if s.timeConn != nil { s.timeConn.Close() }
             s.mu.Unlock()
             return nil
         case <-t.C:
-            s.currentStep++
-            p2, c2, n2 := porthop.Triplet(s.secret, s.currentStep, s.cfg.PortRange.Min, s.cfg.PortRange.Max)
-            newSet := map[int]struct{}{}
-            for _, p := range porthop.UniquePorts([]int{p2, c2, n2}) { newSet[p] = struct{}{} }
-            for p := range newSet {
-                if s.cfg.Protocol == "udp" { s.openUDP(p) } else { s.openPort(p) }
-            }
-            for p := range s.listeners { if _, ok := newSet[p]; !ok { s.closePort(p); if s.name != "" { log.Printf("[%s] 服务端关闭端口: %d", s.name, p) } else { log.Printf("服务端关闭端口: %d", p) } } }
-            for p := range s.udpConns { if _, ok := newSet[p]; !ok { s.closeUDP(p); if s.name != "" { log.Printf("[%s] 服务端关闭端口: %d", s.name, p) } else { log.Printf("服务端关闭端口: %d", p) } } }
-            if s.name != "" { log.Printf("[%s] 服务端轮换: step=%d 监听端口 prev=%d curr=%d next=%d", s.name, s.currentStep, p2, c2, n2) } else { log.Printf("服务端轮换: step=%d 监听端口 prev=%d curr=%d next=%d", s.currentStep, p2, c2, n2) }
         }
+        step := porthop.StepIndex(time.Now(), s.cfg.StepDuration)
+        s.mu.Lock()
+        last := s.currentStep
+        if step == last { s.mu.Unlock(); continue }
+        s.currentStep = step
+        s.syncPortsLocked()
+        s.mu.Unlock()
+        if step != last+1 {
+            if s.name != "" { log.Printf("[%s] 服务端检测到时钟跳变: 原step=%d 新step=%d", s.name, last, step) } else { log.Printf("服务端检测到时钟跳变: 原step=%d 新step=%d", last, step) }
+        }
+        p2, c2, n2 := porthop.StrategyTriplet(s.cfg.HopStrategy, s.currentSecret(), step)
+        ip := s.stepIP(step)
+        if s.name != "" { log.Printf("[%s] 服务端轮换: step=%d 监听端口 prev=%d curr=%d next=%d 当前地址=%s", s.name, step, p2, c2, n2, ip) } else { log.Printf("服务端轮换: step=%d 监听端口 prev=%d curr=%d next=%d 当前地址=%s", step, p2, c2, n2, ip) }
     }
+}
+
+// rotationWait returns the time until the next step boundary, capped at one
+// second so wall-clock jumps and suspend/resume are noticed promptly; the
+// step is always recomputed from the clock after waking.
+func (s *Server) rotationWait() time.Duration {
+    d := porthop.NextRotation(time.Now(), s.cfg.StepDuration)
+    if d > time.Second { d = time.Second }
+    return d
 }
\ No newline at end of file
@@ -0,0 +1,40 @@
+package server
+
+import (
+    "testing"
+    "time"
+    "okaroute/internal/config"
+)
+
+func TestRouteSecretsGrace(t *testing.T) {
+    now := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+    cfg := config.ServerConfig{SkewSteps: 1, StepDuration: 30 * time.Second}
+    s := &Server{cfg: cfg, versions: []secretVersion{
+        {key: []byte("expired"), expire: now.Add(-2 * time.Minute)},
+        {key: []byte("current")},
+        {key: []byte("future"), activate: now.Add(2 * time.Minute)},
+        {key: []byte("expiring"), expire: now.Add(-30 * time.Second)},
+        {key: []byte("activating"), activate: now.Add(30 * time.Second)},
+    }}
+    got := map[string]bool{}
+    for _, k := range s.routeSecrets(now) { got[string(k)] = true }
+    want := map[string]bool{"current": true, "expiring": true, "activating": true}
+    if len(got) != len(want) {
+        t.Fatalf("routeSecrets = %v, want %v", got, want)
+    }
+    for k := range want {
+        if !got[k] { t.Fatalf("routeSecrets = %v, want %v", got, want) }
+    }
+}
+
+func TestRouteSecretsSubSecondStep(t *testing.T) {
+    now := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+    cfg := config.ServerConfig{SkewSteps: 1, StepDuration: 500 * time.Millisecond}
+    s := &Server{cfg: cfg, versions: []secretVersion{
+        {key: []byte("expired"), expire: now.Add(-2 * time.Second)},
+        {key: []byte("future"), activate: now.Add(2 * time.Second)},
+    }}
+    if got := s.routeSecrets(now); len(got) != 0 {
+        t.Fatalf("routeSecrets returned %d secrets outside the 1s grace", len(got))
+    }
+}
\ No newline at end of file
@@ -0,0 +1,39 @@
+package server
+
+import (
+    "log"
+    "net"
+    "time"
+    "okaroute/internal/auth"
+)
+
+func (s *Server) openTimeProbe() error {
+    addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s.cfg.ListenIPs[0], fmtInt(s.cfg.TimeProbePort)))
+    if err != nil { return err }
+    conn, err := net.ListenUDP("udp", addr)
+    if err != nil { return err }
+    s.timeConn = conn
+    if s.name != "" { log.Printf("[%s] 服务端开始监听校时端口(UDP): %d", s.name, s.cfg.TimeProbePort) } else { log.Printf("服务端开始监听校时端口(UDP): %d", s.cfg.TimeProbePort) }
+    go s.timeProbeLoop(conn)
+    return nil
+}
+
+// timeProbeLoop answers authenticated time probes with the server clock so
+// clients can estimate their offset without relying on the hop schedule.
+func (s *Server) timeProbeLoop(conn *net.UDPConn) {
+    buf := make([]byte, 512)
+    for {
+        n, addr, err := conn.ReadFromUDP(buf)
+        if err != nil { return }
+        if !s.sourceAllowed(addr) { s.rejected.Add(1); continue }
+        if s.isBanned(addr) { s.blocked.Add(1); continue }
+        p, err := auth.ParseTimeProbe(buf[:n])
+        if err != nil { s.dropped.Add(1); continue }
+        sec := s.matchSecret(p.ClientID, p.Verify)
+        if sec == nil || !s.clientAllowed(p.ClientID) {
+            s.authFailures.Add(1)
+            continue
+        }
+        conn.WriteToUDP(auth.TimeReply(sec, p, time.Now()), addr)
+    }
+}
\ No newline at end of file